@@ -1,15 +1,45 @@
 AMIUSER=$1
 REPO=$2
+# The volume to build, as found by ami-builder
+DISK=${3:-/dev/xvdf}
+# NVMe partitions have a p before their number, e.g. /dev/nvme1n1p1
+PART=$DISK
+case $DISK in *[0-9]) PART=${DISK}p ;; esac
+# The bootstrap machine has the architecture of the image, x86_64 or aarch64
+RPM_ARCH=$(uname -m)
+# legacy-bios or uefi. aarch64 only boots with UEFI
+BOOT_MODE=${4:-legacy-bios}
+if [ "$RPM_ARCH" = "aarch64" ]; then
+MIRROR=http://mirror.centos.org/altarch/7
+BOOTLOADER="grub2-efi-aa64 shim-aa64 efibootmgr"
+BOOT_MODE=uefi
+else
+MIRROR=http://mirror.centos.org/centos/7
+BOOTLOADER="grub2 grub2-tools"
+if [ "$BOOT_MODE" = "uefi" ]; then
+BOOTLOADER="grub2-efi-x64 shim-x64 efibootmgr"
+fi
+fi
 # Fail on error
 set -e
-yum install -y xfsprogs
+yum install -y xfsprogs dosfstools
 mv /etc/yum.repos.d/* ~/
 
 # Create the filesystems 
-parted /dev/xvdf --script 'mklabel msdos mkpart primary 1M 512M mkpart primary 512M -1s print quit'
-mkfs.xfs -L BOOTFS -f /dev/xvdf1
-pvcreate /dev/xvdf2
-vgcreate -s 4 ami /dev/xvdf2
+if [ "$BOOT_MODE" = "uefi" ]; then
+# UEFI boots from an EFI system partition on a GPT disk
+parted $DISK --script 'mklabel gpt mkpart EFI fat32 1M 201M set 1 boot on mkpart primary 201M 712M mkpart primary 712M -1s print quit'
+mkfs.vfat -F 32 -n EFI ${PART}1
+BOOT=${PART}2
+LVM=${PART}3
+else
+parted $DISK --script 'mklabel msdos mkpart primary 1M 512M mkpart primary 512M -1s print quit'
+BOOT=${PART}1
+LVM=${PART}2
+fi
+mkfs.xfs -L BOOTFS -f $BOOT
+pvcreate $LVM
+vgcreate -s 4 ami $LVM
 # Create the volumes 
 lvcreate -n tmp -L 1G ami
 lvcreate -n home -L 1G ami
@@ -38,7 +68,11 @@ mkdir -p /mnt/ec2-image/var/log
 mount /dev/mapper/ami-var_log /mnt/ec2-image/var/log
 mkdir -p /mnt/ec2-image/var/log/audit
 mount /dev/mapper/ami-var_log_audit /mnt/ec2-image/var/log/audit
-mount /dev/xvdf1 /mnt/ec2-image/boot 
+mount $BOOT /mnt/ec2-image/boot 
+if [ "$BOOT_MODE" = "uefi" ]; then
+mkdir -p /mnt/ec2-image/boot/efi
+mount ${PART}1 /mnt/ec2-image/boot/efi
+fi
  
 # make devices
 mkdir -p /mnt/ec2-image/{dev,etc,proc,sys}
@@ -64,6 +98,9 @@ LABEL=BOOTFS /boot                   xfs     defaults        0 0
 /dev/mapper/ami-var_log_audit /var/log/audit          xfs     defaults        0 0
 /dev/mapper/ami-swap swap                    swap    defaults        0 0
 EOF
+if [ "$BOOT_MODE" = "uefi" ]; then
+echo 'LABEL=EFI /boot/efi               vfat    umask=0077,shortname=winnt 0 0' >> /mnt/ec2-image/etc/fstab
+fi
  
 # create a yum configuration for the installation
 mkdir -p /opt/ec2/yum
@@ -71,22 +108,22 @@ if [ "$REPO" = "default" ]; then
 cat <<EOF> /opt/ec2/yum/yum.conf
 [base]
 name=Base
-baseurl=http://mirror.centos.org/centos/7/os/x86_64/
+baseurl=$MIRROR/os/$RPM_ARCH/
 gpgcheck=0
  
 [updates]
 name=Updates
-baseurl=http://mirror.centos.org/centos/7/updates/x86_64/
+baseurl=$MIRROR/updates/$RPM_ARCH/
 gpgcheck=0
  
 [extras]
 name=Extras
-baseurl=http://mirror.centos.org/centos/7/extras/x86_64/
+baseurl=$MIRROR/extras/$RPM_ARCH/
 gpgcheck=0
  
 [puppetlabs-pc1]
 name=Puppet Labs PC1 Repository el 7 
-baseurl=http://yum.puppetlabs.com/el/7/PC1/x86_64/
+baseurl=http://yum.puppetlabs.com/el/7/PC1/$RPM_ARCH/
 gpgcheck=0
  
 EOF
@@ -116,7 +153,7 @@ EOF
 fi
 
 # Install the OS 
-yum -c /opt/ec2/yum/yum.conf --installroot=/mnt/ec2-image -y install @core kernel openssh-clients grub2 grub2-tools lvm2 cloud-init puppet-agent ipa-client scap-security-guide aide
+yum -c /opt/ec2/yum/yum.conf --installroot=/mnt/ec2-image -y install @core kernel openssh-clients $BOOTLOADER lvm2 cloud-init puppet-agent ipa-client scap-security-guide aide
 
 # Clean up yum
 yum -c /opt/ec2/yum/yum.conf --installroot=/mnt/ec2-image -y clean all
@@ -221,8 +258,13 @@ EOF
 # Relabel files for selinux 
 touch /mnt/ec2-image/.autorelabel
  
-chroot /mnt/ec2-image grub2-install /dev/xvdf
+if [ "$BOOT_MODE" = "uefi" ]; then
+# shim and grub are installed on the EFI system partition by their packages
+chroot /mnt/ec2-image grub2-mkconfig -o /boot/efi/EFI/centos/grub.cfg
+else
+chroot /mnt/ec2-image grub2-install $DISK
 chroot /mnt/ec2-image grub2-mkconfig -o /boot/grub2/grub.cfg
+fi
 chroot /mnt/ec2-image systemctl enable lvm2-lvmetad.service
 chroot /mnt/ec2-image systemctl enable lvm2-lvmetad.socket
 
@@ -1,47 +1,99 @@
 package ami
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"path/filepath"
 
 	"github.com/amdonov/ami-builder/instance"
+	myssh "github.com/amdonov/ami-builder/ssh"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
-func CreateAMI(endpoint string, config *instance.Config, provisioner instance.Provisioner) error {
-	if "" == config.Subnet {
+// Provisioner configures the volume that becomes the AMI. It's attached to
+// the bootstrap machine, which can find it by volumeID, and must be
+// partitioned for bootMode.
+type Provisioner interface {
+	Provision(ctx context.Context, host *myssh.Host, volumeID, bootMode string) error
+}
+
+func CreateAMI(ctx context.Context, ec2Service ec2iface.EC2API, config *instance.Config, provisioner Provisioner) (err error) {
+	if len(config.Subnets) == 0 {
 		return errors.New("subnet is required")
 	}
-	sess, err := session.NewSession()
-	if err != nil {
+	if err = config.Storage.Validate(); err != nil {
+		return err
+	}
+	if err = config.Features.Validate(config.Arch); err != nil {
 		return err
 	}
-	var ec2Service *ec2.EC2
-	if endpoint == "" {
-		ec2Service = ec2.New(sess)
-	} else {
-		ec2Service = ec2.New(sess, &aws.Config{Endpoint: aws.String(endpoint)})
+	if err = config.ValidateCopies(); err != nil {
+		return err
+	}
+	if err = config.Sharing.Validate(); err != nil {
+		return err
 	}
 
-	i, err := instance.Start(ec2Service, config)
+	// Tear down anything left behind if the build fails
+	journal := &instance.Journal{}
+	var i *instance.Server
+	var state *State
+	defer func() {
+		if err != nil {
+			if rbErr := journal.Rollback(ec2Service); rbErr != nil {
+				log.Println(rbErr)
+			}
+			if i != nil && i.KeyFile != "" {
+				log.Printf("Bootstrap private key kept in %s", i.KeyFile)
+			}
+			if state != nil {
+				saved(state)
+			}
+		}
+	}()
+
+	i, err = instance.Start(ctx, ec2Service, config, journal)
 	if err != nil {
 		return err
 	}
+	state = &State{
+		BuildID:         i.BuildID,
+		Name:            config.Name,
+		Family:          config.Family,
+		InstanceID:      *i.Instance.InstanceId,
+		InstanceType:    *i.Instance.InstanceType,
+		Market:          i.Market,
+		SecurityGroupID: i.SecurityGroupID(),
+		KeyFile:         i.KeyFile,
+		Architecture:    instance.Architecture(config.Arch),
+		Storage:         config.Storage.WithDefaults(),
+		Features:        config.Features.WithDefaults(config.Arch),
+		Region:          config.Region,
+		Copies:          append([]instance.Copy(nil), config.CopyTo...),
+		Sharing:         config.Sharing,
+		path:            filepath.Join(i.WorkDir, "state.json"),
+	}
+	if err = state.Save(); err != nil {
+		return err
+	}
 
 	// Create storage in the same AZ as the VM
-	volumeParams := &ec2.CreateVolumeInput{
-		AvailabilityZone: i.Instance.Placement.AvailabilityZone,
-		VolumeType:       aws.String("gp2"),
-		Size:             aws.Int64(20),
-	}
-	volResult, err := ec2Service.CreateVolume(volumeParams)
+	volumeParams := state.Storage.CreateVolumeInput(i.Instance.Placement.AvailabilityZone, i.BuildID)
+	volResult, err := ec2Service.CreateVolumeWithContext(ctx, volumeParams)
 	if err != nil {
 		return err
 	}
+	journal.Record(instance.Volume, *volResult.VolumeId)
+	state.VolumeID = *volResult.VolumeId
+	if err = state.Save(); err != nil {
+		return err
+	}
 	// Wait until volume is available
-	err = ec2Service.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{
+	err = ec2Service.WaitUntilVolumeAvailableWithContext(ctx, &ec2.DescribeVolumesInput{
 		VolumeIds: []*string{volResult.VolumeId},
 	})
 	if err != nil {
@@ -49,68 +101,176 @@ func CreateAMI(endpoint string, config *instance.Config, provisioner instance.Pr
 	}
 	// Attach storage
 	attachParams := &ec2.AttachVolumeInput{
-		Device:     aws.String("/dev/sdf"),
+		Device:     aws.String(attachDevice),
 		VolumeId:   volResult.VolumeId,
 		InstanceId: i.Instance.InstanceId,
 	}
-	_, err = ec2Service.AttachVolume(attachParams)
+	_, err = ec2Service.AttachVolumeWithContext(ctx, attachParams)
 	if err != nil {
 		return err
 	}
+	if err = waitAttached(ctx, ec2Service, volResult.VolumeId); err != nil {
+		return err
+	}
 
-	err = provisioner.Provision(i.IPAddress, i.Key)
+	buildLog, err := i.OpenLog()
 	if err != nil {
 		return err
 	}
-	err = instance.CleanUp(ec2Service, i)
+	defer buildLog.Close()
+	err = provisioner.Provision(ctx, i.Host(), state.VolumeID, state.Features.BootMode)
 	if err != nil {
 		return err
 	}
-	// snapshot volume
-	snapshot, err := ec2Service.CreateSnapshot(&ec2.CreateSnapshotInput{
-		VolumeId:    volResult.VolumeId,
-		Description: aws.String(config.Name),
-	})
-	if err != nil {
+	// Keep the provisioned volume if a later step fails so the build can be resumed
+	journal.Forget(instance.Volume, state.VolumeID)
+	if err = state.Complete(Provisioned); err != nil {
 		return err
 	}
-	log.Println("Waiting for snapshot to complete")
-	err = ec2Service.WaitUntilSnapshotCompleted(&ec2.DescribeSnapshotsInput{
-		SnapshotIds: []*string{snapshot.SnapshotId},
-	})
+	err = instance.CleanUp(ctx, ec2Service, i)
 	if err != nil {
 		return err
 	}
-	// delete the volume
-	_, err = ec2Service.DeleteVolume(&ec2.DeleteVolumeInput{
-		VolumeId: volResult.VolumeId,
-	})
+	if err = state.Complete(CleanedUp); err != nil {
+		return err
+	}
+	return finish(ctx, ec2Service, config.Regional, state)
+}
+
+// Resume continues a failed build from the last phase recorded in its state file.
+func Resume(ctx context.Context, ec2Service ec2iface.EC2API, regional instance.Regional, path string) (err error) {
+	state, err := LoadState(path)
 	if err != nil {
 		return err
 	}
+	if !state.Done(Provisioned) {
+		return fmt.Errorf("build %s failed before provisioning completed and must be run again", state.BuildID)
+	}
+	if len(state.Copies) > 0 && regional == nil {
+		return fmt.Errorf("build %s copies the image to other regions, which requires regional clients", state.BuildID)
+	}
+	defer func() {
+		if err != nil {
+			saved(state)
+		}
+	}()
+	log.Printf("Resuming build %s after %s", state.BuildID, state.Phases[len(state.Phases)-1])
+	return finish(ctx, ec2Service, regional, state)
+}
 
-	// Register the AMI
-	regResult, err := ec2Service.RegisterImage(&ec2.RegisterImageInput{
-		Name:               aws.String(config.Name),
-		Description:        aws.String(config.Name),
-		Architecture:       aws.String("x86_64"),
-		RootDeviceName:     aws.String("/dev/sda1"),
-		VirtualizationType: aws.String("hvm"),
-		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
-			{ // Required
-				DeviceName: aws.String("/dev/sda1"),
-				Ebs: &ec2.EbsBlockDevice{
-					DeleteOnTermination: aws.Bool(true),
-					SnapshotId:          snapshot.SnapshotId,
-					VolumeSize:          aws.Int64(20),
-					VolumeType:          aws.String("gp2"),
+// saved reports where a failed build left its state.
+func saved(state *State) {
+	if !state.Done(Provisioned) {
+		// Nothing worth resuming
+		if err := state.Remove(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	log.Printf("Build state saved. Run ami-builder resume %s to continue", state.Path())
+}
+
+// finish snapshots the provisioned volume, registers the AMI, copies it to
+// other regions and shares it.
+func finish(ctx context.Context, ec2Service ec2iface.EC2API, regional instance.Regional, state *State) error {
+	if !state.Done(Snapshotted) {
+		if state.SnapshotID == "" {
+			snapshot, err := ec2Service.CreateSnapshotWithContext(ctx, &ec2.CreateSnapshotInput{
+				VolumeId:          aws.String(state.VolumeID),
+				Description:       aws.String(state.Name),
+				TagSpecifications: instance.TagSpecifications(state.BuildID, ec2.ResourceTypeSnapshot),
+			})
+			if err != nil {
+				return err
+			}
+			state.SnapshotID = *snapshot.SnapshotId
+			if err = state.Save(); err != nil {
+				return err
+			}
+		}
+		log.Println("Waiting for snapshot to complete")
+		err := ec2Service.WaitUntilSnapshotCompletedWithContext(ctx, &ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(state.SnapshotID)},
+		})
+		if err != nil {
+			return err
+		}
+		if err = state.Complete(Snapshotted); err != nil {
+			return err
+		}
+	}
+	if !state.Done(VolumeDeleted) {
+		// delete the volume
+		_, err := ec2Service.DeleteVolumeWithContext(ctx, &ec2.DeleteVolumeInput{
+			VolumeId: aws.String(state.VolumeID),
+		})
+		if err != nil {
+			return err
+		}
+		if err = state.Complete(VolumeDeleted); err != nil {
+			return err
+		}
+	}
+	if !state.Done(Registered) {
+		// Register the AMI
+		input := &ec2.RegisterImageInput{
+			Name:               aws.String(state.Name),
+			Description:        aws.String(state.Name),
+			Architecture:       aws.String(instance.Architecture(state.Architecture)),
+			RootDeviceName:     aws.String("/dev/sda1"),
+			VirtualizationType: aws.String("hvm"),
+			BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+				{ // Required
+					DeviceName: aws.String("/dev/sda1"),
+					Ebs:        state.Storage.EBS(state.SnapshotID),
 				},
 			},
-		},
-	})
-	if err != nil {
+			TagSpecifications: instance.TagSpecifications(state.BuildID, ec2.ResourceTypeImage),
+		}
+		if state.Family != "" {
+			input.TagSpecifications[0].Tags = append(input.TagSpecifications[0].Tags, &ec2.Tag{
+				Key:   aws.String(instance.FamilyTag),
+				Value: aws.String(state.Family),
+			})
+		}
+		state.Features.Register(input)
+		regResult, err := ec2Service.RegisterImageWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		state.ImageID = *regResult.ImageId
+		if err = state.Complete(Registered); err != nil {
+			return err
+		}
+	}
+	log.Printf("AMI registered with id of %s", state.ImageID)
+	if len(state.Copies) > 0 && !state.Done(Copied) {
+		if err := copyImage(ctx, ec2Service, regional, state); err != nil {
+			return err
+		}
+		if err := state.Complete(Copied); err != nil {
+			return err
+		}
+	}
+	for _, c := range state.Copies {
+		log.Printf("AMI available in %s with id of %s", c.Region, c.ImageID)
+	}
+	if !state.Sharing.Empty() && !state.Done(Shared) {
+		if err := Share(ctx, ec2Service, state.ImageID, state.Sharing); err != nil {
+			return err
+		}
+		for _, c := range state.Copies {
+			if err := Share(ctx, regional(c.Region), c.ImageID, state.Sharing); err != nil {
+				return err
+			}
+		}
+		if err := state.Complete(Shared); err != nil {
+			return err
+		}
+	}
+	if err := writeManifest(state); err != nil {
 		return err
 	}
-	log.Printf("AMI registered with id of %s", *regResult.ImageId)
-	return nil
+	log.Printf("Build manifest written to %s", state.ManifestPath())
+	return state.Remove()
 }
@@ -0,0 +1,482 @@
+package ami
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/amdonov/ami-builder/instance"
+	myssh "github.com/amdonov/ami-builder/ssh"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+type provisioner struct {
+	err      error
+	calls    int
+	host     *myssh.Host
+	volumeID string
+	bootMode string
+	// check inspects the build while provisioning
+	check func()
+}
+
+func (p *provisioner) Provision(ctx context.Context, host *myssh.Host, volumeID, bootMode string) error {
+	p.calls++
+	p.host = host
+	p.volumeID = volumeID
+	p.bootMode = bootMode
+	if p.check != nil {
+		p.check()
+	}
+	return p.err
+}
+
+func init() {
+	attachInterval = time.Millisecond
+}
+
+// inTempDir runs the test from an empty directory so state files don't leak.
+func inTempDir(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// sshHost starts a fake bootstrap machine and returns how to reach it.
+func sshHost(t *testing.T) (*fake.SSH, *myssh.Host) {
+	private, public, err := instance.GenerateKey(instance.ED25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := fake.NewSSH(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, &myssh.Host{Address: server.Addr, Key: private, Fingerprints: []string{server.Fingerprint}}
+}
+
+func newFake() (*fake.EC2, *instance.Config) {
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	return f, &instance.Config{
+		Subnets:  []string{"subnet-1"},
+		Name:     "test image",
+		ImageID:  "ami-base",
+		Sizes:    []string{"t2.micro"},
+		SSHCIDRs: []string{"192.0.2.0/24"},
+	}
+}
+
+// stateFiles lists state files and private keys, ignoring manifests and
+// build logs.
+func stateFiles(t *testing.T, dir string) []string {
+	var files []string
+	for _, pattern := range []string{"bootstrap-*/state.json", "bootstrap-*/id_*"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, matches...)
+	}
+	return files
+}
+
+func loadManifest(t *testing.T, dir string) *Manifest {
+	files, err := filepath.Glob(filepath.Join(dir, "bootstrap-*", "manifest.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one manifest, got %v (%v)", files, err)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &Manifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+// assertNoTemporaryResources checks that only the AMI and its snapshot remain.
+func assertNoTemporaryResources(t *testing.T, f *fake.EC2) {
+	if len(f.KeyPairs) != 0 {
+		t.Errorf("key pairs left behind: %v", f.KeyPairs)
+	}
+	if len(f.SecurityGroups) != 0 {
+		t.Errorf("security groups left behind: %v", f.SecurityGroups)
+	}
+	if len(f.Volumes) != 0 {
+		t.Errorf("volumes left behind: %v", f.Volumes)
+	}
+	for id, i := range f.Instances {
+		if aws.StringValue(i.State.Name) != ec2.InstanceStateNameTerminated {
+			t.Errorf("instance %s is %s", id, aws.StringValue(i.State.Name))
+		}
+	}
+}
+
+func TestCreateAMI(t *testing.T) {
+	dir := inTempDir(t)
+	f, config := newFake()
+	config.Bastion = &myssh.Bastion{User: "ec2-user", Address: "jump.example.com:22"}
+	p := &provisioner{}
+	p.check = func() {
+		// The volume is attached before provisioning starts
+		v := f.Volumes[p.volumeID]
+		if v == nil || len(v.Attachments) != 1 || aws.StringValue(v.Attachments[0].State) != ec2.VolumeAttachmentStateAttached {
+			t.Errorf("volume %s isn't attached: %v", p.volumeID, v)
+		}
+	}
+	if err := CreateAMI(context.Background(), f, config, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.calls != 1 {
+		t.Errorf("provisioner called %d times", p.calls)
+	}
+	if p.host.Address == "" || len(p.host.Key) == 0 || p.host.Bastion != config.Bastion {
+		t.Errorf("unexpected host %+v", p.host)
+	}
+	if f.Called("DescribeVolumes") != 2 {
+		t.Errorf("attachment checked %d times", f.Called("DescribeVolumes"))
+	}
+	assertNoTemporaryResources(t, f)
+	if len(f.Images) != 1 || len(f.Snapshots) != 1 {
+		t.Fatalf("expected one image and snapshot, got %d and %d", len(f.Images), len(f.Snapshots))
+	}
+	for _, image := range f.Images {
+		if aws.StringValue(image.Name) != config.Name {
+			t.Errorf("image named %q", aws.StringValue(image.Name))
+		}
+		snapshotID := aws.StringValue(image.BlockDeviceMappings[0].Ebs.SnapshotId)
+		if _, ok := f.Snapshots[snapshotID]; !ok {
+			t.Errorf("image references unknown snapshot %s", snapshotID)
+		}
+	}
+	if files := stateFiles(t, dir); len(files) != 0 {
+		t.Errorf("state files left behind: %v", files)
+	}
+	manifest := loadManifest(t, dir)
+	if _, ok := f.Images[manifest.ImageID]; !ok || manifest.Market != instance.OnDemand {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+}
+
+func TestCreateAMIOnSpot(t *testing.T) {
+	dir := inTempDir(t)
+	f, config := newFake()
+	config.Spot = true
+	config.SpotMaxPrice = "0.05"
+	if err := CreateAMI(context.Background(), f, config, &provisioner{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range f.Instances {
+		if aws.StringValue(i.InstanceLifecycle) != ec2.InstanceLifecycleTypeSpot {
+			t.Errorf("instance %s is not spot", aws.StringValue(i.InstanceId))
+		}
+	}
+	if manifest := loadManifest(t, dir); manifest.Market != ec2.MarketTypeSpot || manifest.InstanceType != "t2.micro" {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+}
+
+func TestCreateAMIRetriesCapacity(t *testing.T) {
+	inTempDir(t)
+	f, config := newFake()
+	f.AddSubnet("subnet-2", "vpc-1", "us-east-1b")
+	config.Subnets = []string{"subnet-1", "subnet-2"}
+	config.Sizes = []string{"m5.large", "t2.micro"}
+	f.FailOn("RunInstances", awserr.New("InsufficientInstanceCapacity", "no capacity", nil))
+	f.FailOn("RunInstances", awserr.New("Unsupported", "not offered", nil))
+	f.FailOn("RunInstances", awserr.New("InsufficientInstanceCapacity", "no capacity", nil))
+	p := &provisioner{check: func() {
+		for _, i := range f.Instances {
+			if aws.StringValue(i.InstanceType) != "t2.micro" || aws.StringValue(i.SubnetId) != "subnet-2" {
+				t.Errorf("launched %s in %s", aws.StringValue(i.InstanceType), aws.StringValue(i.SubnetId))
+			}
+		}
+		for _, v := range f.Volumes {
+			if aws.StringValue(v.AvailabilityZone) != "us-east-1b" {
+				t.Errorf("volume created in %s", aws.StringValue(v.AvailabilityZone))
+			}
+		}
+	}}
+	if err := CreateAMI(context.Background(), f, config, p); err != nil {
+		t.Fatal(err)
+	}
+	if f.Called("RunInstances") != 4 {
+		t.Errorf("RunInstances called %d times", f.Called("RunInstances"))
+	}
+}
+
+func TestCreateAMIWithStorage(t *testing.T) {
+	inTempDir(t)
+	f, config := newFake()
+	config.Storage = instance.Storage{Size: 40, Type: "gp3", IOPS: 6000, Throughput: 400, Encrypted: true, KMSKeyID: "alias/ami"}
+	p := &provisioner{check: func() {
+		for _, v := range f.Volumes {
+			// Skip the bootstrap machine's root volume
+			if len(v.Attachments) > 0 && aws.BoolValue(v.Attachments[0].DeleteOnTermination) {
+				continue
+			}
+			if aws.Int64Value(v.Size) != 40 || aws.StringValue(v.VolumeType) != "gp3" || aws.Int64Value(v.Iops) != 6000 ||
+				aws.Int64Value(v.Throughput) != 400 || !aws.BoolValue(v.Encrypted) || aws.StringValue(v.KmsKeyId) != "alias/ami" {
+				t.Errorf("unexpected volume %v", v)
+			}
+		}
+	}}
+	if err := CreateAMI(context.Background(), f, config, p); err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range f.Images {
+		ebs := image.BlockDeviceMappings[0].Ebs
+		if aws.Int64Value(ebs.VolumeSize) != 40 || aws.StringValue(ebs.VolumeType) != "gp3" || aws.Int64Value(ebs.Iops) != 6000 ||
+			aws.Int64Value(ebs.Throughput) != 400 || !aws.BoolValue(ebs.Encrypted) {
+			t.Errorf("unexpected block device %v", ebs)
+		}
+	}
+	for _, s := range f.Snapshots {
+		if !aws.BoolValue(s.Encrypted) {
+			t.Error("snapshot isn't encrypted")
+		}
+	}
+}
+
+func TestCreateAMIRejectsInvalidStorage(t *testing.T) {
+	inTempDir(t)
+	f, config := newFake()
+	for _, storage := range []instance.Storage{
+		{Type: "io2"},
+		// Too small for the scripts' partitions
+		{Size: 8},
+	} {
+		config.Storage = storage
+		if err := CreateAMI(context.Background(), f, config, &provisioner{}); err == nil {
+			t.Fatalf("%+v: expected an error", storage)
+		}
+	}
+	if len(f.Calls) != 0 {
+		t.Errorf("AWS called before validation: %v", f.Calls)
+	}
+}
+
+func TestCreateAMIArm64(t *testing.T) {
+	dir := inTempDir(t)
+	f, config := newFake()
+	f.AddBaseImage("ami-arm", instance.ARM64)
+	config.ImageID = "ami-arm"
+	config.Sizes = []string{"t4g.micro"}
+	config.Arch = instance.ARM64
+	if err := CreateAMI(context.Background(), f, config, &provisioner{}); err != nil {
+		t.Fatal(err)
+	}
+	for id, image := range f.Images {
+		if aws.StringValue(image.Architecture) != instance.ARM64 {
+			t.Errorf("%s registered as %s", id, aws.StringValue(image.Architecture))
+		}
+	}
+	if manifest := loadManifest(t, dir); manifest.Architecture != instance.ARM64 || manifest.BootMode != instance.UEFI {
+		t.Errorf("manifest architecture %q and boot mode %q", manifest.Architecture, manifest.BootMode)
+	}
+}
+
+func TestCreateAMIWithFeatures(t *testing.T) {
+	dir := inTempDir(t)
+	f, config := newFake()
+	config.Features = instance.Features{BootMode: instance.UEFI, ImdsSupport: "v2.0", EnaSupport: true, SriovNetSupport: true}
+	p := &provisioner{}
+	if err := CreateAMI(context.Background(), f, config, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.bootMode != instance.UEFI {
+		t.Errorf("volume provisioned for %q", p.bootMode)
+	}
+	for id, image := range f.Images {
+		if aws.StringValue(image.BootMode) != instance.UEFI || aws.StringValue(image.ImdsSupport) != "v2.0" ||
+			!aws.BoolValue(image.EnaSupport) || aws.StringValue(image.SriovNetSupport) != "simple" {
+			t.Errorf("%s registered with %v", id, image)
+		}
+	}
+	if manifest := loadManifest(t, dir); manifest.BootMode != instance.UEFI {
+		t.Errorf("manifest boot mode %q", manifest.BootMode)
+	}
+}
+
+func TestCreateAMIRejectsInvalidFeatures(t *testing.T) {
+	inTempDir(t)
+	f, config := newFake()
+	config.Arch = instance.ARM64
+	config.Features = instance.Features{BootMode: instance.LegacyBIOS}
+	if err := CreateAMI(context.Background(), f, config, &provisioner{}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(f.Calls) != 0 {
+		t.Errorf("AWS called before validation: %v", f.Calls)
+	}
+}
+
+func TestCreateAMITagsFamily(t *testing.T) {
+	inTempDir(t)
+	f, config := newFake()
+	config.Family = "base"
+	if err := CreateAMI(context.Background(), f, config, &provisioner{}); err != nil {
+		t.Fatal(err)
+	}
+	for id, image := range f.Images {
+		family := ""
+		for _, tag := range image.Tags {
+			if aws.StringValue(tag.Key) == instance.FamilyTag {
+				family = aws.StringValue(tag.Value)
+			}
+		}
+		if family != "base" {
+			t.Errorf("%s tagged with %v", id, image.Tags)
+		}
+	}
+}
+
+func TestCreateAMIRollsBackFailedProvisioning(t *testing.T) {
+	dir := inTempDir(t)
+	f, config := newFake()
+	failure := errors.New("Process exited with status 1")
+	err := CreateAMI(context.Background(), f, config, &provisioner{err: failure})
+	if err != failure {
+		t.Fatalf("expected provisioning error, got %v", err)
+	}
+	assertNoTemporaryResources(t, f)
+	if len(f.Snapshots) != 0 || len(f.Images) != 0 {
+		t.Errorf("unexpected snapshots %v or images %v", f.Snapshots, f.Images)
+	}
+	// Only the private key is kept for troubleshooting
+	files := stateFiles(t, dir)
+	if len(files) != 1 || filepath.Base(files[0]) != "id_ed25519" {
+		t.Fatalf("expected only the private key, got %v", files)
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("private key mode is %v", info.Mode())
+	}
+}
+
+func TestCreateAMIRollsBackFailedStart(t *testing.T) {
+	inTempDir(t)
+	f, config := newFake()
+	f.FailOn("RunInstances", awserr.New("InsufficientInstanceCapacity", "no capacity", nil))
+	p := &provisioner{}
+	if err := CreateAMI(context.Background(), f, config, p); err == nil {
+		t.Fatal("expected an error")
+	}
+	if p.calls != 0 {
+		t.Error("provisioner should not run")
+	}
+	assertNoTemporaryResources(t, f)
+}
+
+func TestCreateAMICancelledWhileStarting(t *testing.T) {
+	inTempDir(t)
+	f, config := newFake()
+	// Without fingerprints on the console the build waits for them
+	f.ConsoleOutput = ""
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p := &provisioner{}
+	if err := CreateAMI(ctx, f, config, p); err != context.DeadlineExceeded {
+		t.Fatalf("expected the build to stop, got %v", err)
+	}
+	if p.calls != 0 {
+		t.Error("provisioner should not run")
+	}
+	if f.Called("RunInstances") != 1 {
+		t.Fatalf("cancelled before the instance launched: %v", f.Calls)
+	}
+	assertNoTemporaryResources(t, f)
+}
+
+func TestCreateAMICancelledWhileProvisioning(t *testing.T) {
+	dir := inTempDir(t)
+	f, config := newFake()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Provisioning stops as it would on Ctrl-C
+	p := &provisioner{check: cancel, err: context.Canceled}
+	if err := CreateAMI(ctx, f, config, p); err != context.Canceled {
+		t.Fatalf("expected the build to stop, got %v", err)
+	}
+	assertNoTemporaryResources(t, f)
+	if len(f.Snapshots) != 0 || len(f.Images) != 0 {
+		t.Errorf("unexpected snapshots %v or images %v", f.Snapshots, f.Images)
+	}
+	if files := stateFiles(t, dir); len(files) != 1 || filepath.Base(files[0]) != "id_ed25519" {
+		t.Errorf("expected only the private key, got %v", files)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := inTempDir(t)
+	f, config := newFake()
+	f.FailOn("RegisterImage", awserr.New("RequestLimitExceeded", "slow down", nil))
+	p := &provisioner{}
+	if err := CreateAMI(context.Background(), f, config, p); err == nil {
+		t.Fatal("expected an error")
+	}
+	assertNoTemporaryResources(t, f)
+	if len(f.Snapshots) != 1 {
+		t.Fatalf("expected the snapshot to be kept, got %v", f.Snapshots)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "bootstrap-*", "state.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one state file, got %v (%v)", files, err)
+	}
+	state, err := LoadState(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Done(VolumeDeleted) || state.Done(Registered) {
+		t.Errorf("unexpected phases %v", state.Phases)
+	}
+
+	if err = Resume(context.Background(), f, nil, files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if p.calls != 1 {
+		t.Errorf("provisioner called %d times", p.calls)
+	}
+	if f.Called("CreateSnapshot") != 1 {
+		t.Errorf("snapshot created %d times", f.Called("CreateSnapshot"))
+	}
+	if len(f.Images) != 1 {
+		t.Errorf("expected one image, got %v", f.Images)
+	}
+	if files := stateFiles(t, dir); len(files) != 0 {
+		t.Errorf("state files left behind: %v", files)
+	}
+}
+
+func TestResumeBeforeProvisioning(t *testing.T) {
+	dir := inTempDir(t)
+	state := &State{BuildID: "bootstrap-1", path: filepath.Join(dir, "bootstrap-1.json")}
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Resume(context.Background(), fake.NewEC2(), nil, state.Path()); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -1,14 +1,10 @@
 package ami
 
 import (
+	"context"
 	"fmt"
-	"os"
 
-	"golang.org/x/crypto/ssh"
-
-	"github.com/amdonov/ami-builder/instance"
 	myssh "github.com/amdonov/ami-builder/ssh"
-	"github.com/tmc/scp"
 )
 
 type cloudInit struct {
@@ -17,24 +13,22 @@ type cloudInit struct {
 	repo      string
 }
 
-func NewCloudInitProvisioner(user, imageUser, repo string) instance.Provisioner {
+func NewCloudInitProvisioner(user, imageUser, repo string) Provisioner {
 	return &cloudInit{user, imageUser, repo}
 }
 
-func (c *cloudInit) Provision(ip string, key []byte) error {
-	client, err := myssh.Connect(c.user, ip, key)
+func (c *cloudInit) Provision(ctx context.Context, host *myssh.Host, volumeID, bootMode string) error {
+	client, err := myssh.Connect(ctx, c.user, host)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
-	err = client.RunCommand(func(session *ssh.Session) error {
-		return scp.CopyPath("ami.sh", "~/ami.sh", session)
-	})
+	device, err := findDevice(ctx, client, volumeID)
 	if err != nil {
 		return err
 	}
-	return client.RunCommand(func(session *ssh.Session) error {
-		session.Stdout = os.Stdout
-		return session.Run(fmt.Sprintf("sudo /bin/bash ./ami.sh %s %s", c.imageUser, c.repo))
-	})
+	if err = client.Upload(ctx, "ami.sh", "~/ami.sh"); err != nil {
+		return err
+	}
+	return client.Run(ctx, "ami.sh", fmt.Sprintf("sudo /bin/bash ./ami.sh %s %s %s %s", c.imageUser, c.repo, device, bootMode))
 }
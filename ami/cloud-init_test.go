@@ -0,0 +1,73 @@
+package ami
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	myssh "github.com/amdonov/ami-builder/ssh"
+)
+
+func TestCloudInitProvision(t *testing.T) {
+	inTempDir(t)
+	ioutil.WriteFile("ami.sh", []byte("#!/bin/bash\n"), 0644)
+	server, host := sshHost(t)
+	server.Respond("serial=vol0123456789abcdef0\n", 0, "/dev/nvme1n1\n", "")
+	p := NewCloudInitProvisioner("centos", "ec2-user", "10.0.0.5")
+	if err := p.Provision(context.Background(), host, "vol-0123456789abcdef0", "uefi"); err != nil {
+		t.Fatal(err)
+	}
+	files := server.Files()
+	if len(files) != 1 || string(files["/home/centos/ami.sh"]) != "#!/bin/bash\n" {
+		t.Errorf("unexpected uploads %q", files)
+	}
+	expected := []string{"sudo /bin/bash ./ami.sh ec2-user 10.0.0.5 /dev/nvme1n1 uefi"}
+	if commands := server.Commands(); !reflect.DeepEqual(commands[1:], expected) {
+		t.Errorf("expected %q, got %q", expected, commands)
+	}
+}
+
+func TestCloudInitProvisionFails(t *testing.T) {
+	inTempDir(t)
+	ioutil.WriteFile("ami.sh", []byte("#!/bin/bash\n"), 0644)
+	server, host := sshHost(t)
+	server.Respond("lsblk", 0, "/dev/xvdf\n", "")
+	server.Respond("ami.sh", 1, "Installing packages\n", "No package grub2 available.\n")
+	err := NewCloudInitProvisioner("centos", "ec2-user", "10.0.0.5").Provision(context.Background(), host, "vol-1", "legacy-bios")
+	var commandErr *myssh.CommandError
+	if !errors.As(err, &commandErr) {
+		t.Fatalf("expected a command error, got %v", err)
+	}
+	if commandErr.ExitStatus != 1 || len(commandErr.Tail) != 2 {
+		t.Errorf("unexpected error %+v", commandErr)
+	}
+}
+
+func TestCloudInitProvisionNeedsScript(t *testing.T) {
+	inTempDir(t)
+	server, host := sshHost(t)
+	server.Respond("lsblk", 0, "/dev/xvdf\n", "")
+	if err := NewCloudInitProvisioner("centos", "ec2-user", "10.0.0.5").Provision(context.Background(), host, "vol-1", "legacy-bios"); err == nil {
+		t.Error("expected an error")
+	}
+	if commands := server.Commands(); len(commands) != 1 {
+		t.Errorf("ran %q", commands)
+	}
+}
+
+func TestCloudInitProvisionNeedsDevice(t *testing.T) {
+	inTempDir(t)
+	ioutil.WriteFile("ami.sh", []byte("#!/bin/bash\n"), 0644)
+	server, host := sshHost(t)
+	server.Respond("lsblk", 1, "", "")
+	err := NewCloudInitProvisioner("centos", "ec2-user", "10.0.0.5").Provision(context.Background(), host, "vol-1", "legacy-bios")
+	if err == nil || !strings.Contains(err.Error(), "volume vol-1 not found") {
+		t.Errorf("expected the device not to be found, got %v", err)
+	}
+	if files := server.Files(); len(files) != 0 {
+		t.Errorf("uploaded %q", files)
+	}
+}
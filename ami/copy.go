@@ -0,0 +1,103 @@
+package ami
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amdonov/ami-builder/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Copies can take hours for large images, so wait up to 4 hours rather than
+// the waiter's default 10 minutes
+var copyWait = []request.WaiterOption{
+	request.WithWaiterDelay(request.ConstantWaiterDelay(30 * time.Second)),
+	request.WithWaiterMaxAttempts(480),
+}
+
+// copyImage copies the registered image to every region in state.Copies at
+// once, with its tags, and waits for the copies to become available. Copies
+// started by an earlier attempt are only waited for.
+func copyImage(ctx context.Context, ec2Service ec2iface.EC2API, regional instance.Regional, state *State) error {
+	images, err := ec2Service.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(state.ImageID)},
+	})
+	if err != nil {
+		return err
+	}
+	var tags []*ec2.Tag
+	if len(images.Images) > 0 {
+		tags = images.Images[0].Tags
+	}
+	// mu guards the copies' image IDs and saving the state
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, len(state.Copies))
+	for i := range state.Copies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = copyTo(ctx, regional(state.Copies[i].Region), state, &state.Copies[i], tags, &mu)
+		}(i)
+	}
+	wg.Wait()
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", state.Copies[i].Region, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to copy %s to %s", state.ImageID, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func copyTo(ctx context.Context, ec2Service ec2iface.EC2API, state *State, c *instance.Copy, tags []*ec2.Tag, mu *sync.Mutex) error {
+	mu.Lock()
+	imageID := c.ImageID
+	mu.Unlock()
+	if imageID == "" {
+		input := &ec2.CopyImageInput{
+			Name:          aws.String(state.Name),
+			Description:   aws.String(state.Name),
+			SourceImageId: aws.String(state.ImageID),
+			SourceRegion:  aws.String(state.Region),
+		}
+		if c.KMSKeyID != "" {
+			input.Encrypted = aws.Bool(true)
+			input.KmsKeyId = aws.String(c.KMSKeyID)
+		}
+		if len(tags) > 0 {
+			for _, resourceType := range []string{ec2.ResourceTypeImage, ec2.ResourceTypeSnapshot} {
+				input.TagSpecifications = append(input.TagSpecifications, &ec2.TagSpecification{
+					ResourceType: aws.String(resourceType),
+					Tags:         tags,
+				})
+			}
+		}
+		result, err := ec2Service.CopyImageWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		imageID = *result.ImageId
+		mu.Lock()
+		c.ImageID = imageID
+		err = state.Save()
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		log.Printf("Copying AMI to %s as %s", c.Region, imageID)
+	}
+	return ec2Service.WaitUntilImageAvailableWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(imageID)},
+	}, copyWait...)
+}
@@ -0,0 +1,90 @@
+package ami
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/amdonov/ami-builder/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// withCopies has config copy to us-west-2 and, re-encrypted, eu-west-1,
+// returning the fakes for those regions.
+func withCopies(config *instance.Config) map[string]*fake.EC2 {
+	regions := map[string]*fake.EC2{"us-west-2": fake.NewEC2(), "eu-west-1": fake.NewEC2()}
+	for region, f := range regions {
+		f.Region = region
+	}
+	config.Region = "us-east-1"
+	config.Regional = func(region string) ec2iface.EC2API { return regions[region] }
+	config.CopyTo = []instance.Copy{{Region: "us-west-2"}, {Region: "eu-west-1", KMSKeyID: "alias/dr"}}
+	return regions
+}
+
+func TestCreateAMICopiesToRegions(t *testing.T) {
+	dir := inTempDir(t)
+	f, config := newFake()
+	regions := withCopies(config)
+	if err := CreateAMI(context.Background(), f, config, &provisioner{}); err != nil {
+		t.Fatal(err)
+	}
+	manifest := loadManifest(t, dir)
+	if len(manifest.Copies) != 2 {
+		t.Fatalf("expected two copies in the manifest, got %v", manifest.Copies)
+	}
+	for region, regional := range regions {
+		image, ok := regional.Images[manifest.Copies[region]]
+		if !ok {
+			t.Errorf("%s has no image %s", region, manifest.Copies[region])
+			continue
+		}
+		if aws.StringValue(image.State) != "available" || aws.StringValue(image.Name) != config.Name {
+			t.Errorf("%s copy is %s named %s", region, aws.StringValue(image.State), aws.StringValue(image.Name))
+		}
+		if _, ok := instance.CreatedAt(image.Tags); !ok || len(image.Tags) != 3 {
+			t.Errorf("%s copy tagged with %v", region, image.Tags)
+		}
+		snapshot := regional.Snapshots[aws.StringValue(image.BlockDeviceMappings[0].Ebs.SnapshotId)]
+		key := ""
+		if region == "eu-west-1" {
+			key = "alias/dr"
+		}
+		if aws.BoolValue(snapshot.Encrypted) != (key != "") || aws.StringValue(snapshot.KmsKeyId) != key {
+			t.Errorf("%s copy encrypted %v with %q", region, aws.BoolValue(snapshot.Encrypted), aws.StringValue(snapshot.KmsKeyId))
+		}
+	}
+}
+
+func TestResumeFinishesCopies(t *testing.T) {
+	dir := inTempDir(t)
+	f, config := newFake()
+	regions := withCopies(config)
+	regions["eu-west-1"].FailOn("CopyImage", awserr.New("ResourceLimitExceeded", "too many copies in progress", nil))
+	if err := CreateAMI(context.Background(), f, config, &provisioner{}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(regions["us-west-2"].Images) != 1 {
+		t.Errorf("us-west-2 wasn't copied to: %v", regions["us-west-2"].Images)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "bootstrap-*", "state.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one state file, got %v (%v)", files, err)
+	}
+	if err = Resume(context.Background(), f, config.Regional, files[0]); err != nil {
+		t.Fatal(err)
+	}
+	// The copy that started is waited for rather than repeated
+	if regions["us-west-2"].Called("CopyImage") != 1 || regions["eu-west-1"].Called("CopyImage") != 2 {
+		t.Errorf("copied %d and %d times", regions["us-west-2"].Called("CopyImage"), regions["eu-west-1"].Called("CopyImage"))
+	}
+	if f.Called("RegisterImage") != 1 {
+		t.Errorf("registered %d times", f.Called("RegisterImage"))
+	}
+	if manifest := loadManifest(t, dir); len(manifest.Copies) != 2 {
+		t.Errorf("expected two copies in the manifest, got %v", manifest.Copies)
+	}
+}
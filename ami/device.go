@@ -0,0 +1,79 @@
+package ami
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	myssh "github.com/amdonov/ami-builder/ssh"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"golang.org/x/crypto/ssh"
+)
+
+// attachDevice is the name the volume is attached as. Xen instances show it
+// as /dev/xvdf, Nitro instances as whichever NVMe device is next.
+const attachDevice = "/dev/sdf"
+
+// attachInterval is how often the attachment is checked.
+var attachInterval = 5 * time.Second
+
+// waitAttached waits until the volume's attachment is attached.
+func waitAttached(ctx context.Context, ec2Service ec2iface.EC2API, volumeID *string) error {
+	for i := 0; i < 60; i = i + 1 {
+		resp, err := ec2Service.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+			VolumeIds: []*string{volumeID},
+		})
+		if err != nil {
+			return err
+		}
+		for _, v := range resp.Volumes {
+			for _, attachment := range v.Attachments {
+				if aws.StringValue(attachment.State) == ec2.VolumeAttachmentStateAttached {
+					return nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(attachInterval):
+		}
+	}
+	return fmt.Errorf("volume %s not attached after %s", aws.StringValue(volumeID), 60*attachInterval)
+}
+
+// deviceScript prints the block device of a volume. Nitro instances use the
+// volume ID without its dash as the NVMe serial number. udev may take a
+// moment to create the device after the volume is attached.
+const deviceScript = `serial=%s
+for i in $(seq 30); do
+  device=$(lsblk -dnpo NAME,SERIAL | awk -v serial=$serial '$2 == serial { print $1 }')
+  link=/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_$serial
+  if [ -z "$device" ] && [ -e $link ]; then device=$(readlink -f $link); fi
+  for xen in %s; do
+    if [ -z "$device" ] && [ -b $xen ]; then device=$xen; fi
+  done
+  if [ -n "$device" ]; then echo $device; exit 0; fi
+  sleep 1
+done
+exit 1`
+
+// findDevice returns the block device the volume is attached as.
+func findDevice(ctx context.Context, client *myssh.Client, volumeID string) (string, error) {
+	serial := strings.Replace(volumeID, "-", "", 1)
+	xen := strings.Replace(attachDevice, "/dev/sd", "/dev/xvd", 1) + " " + attachDevice
+	var out bytes.Buffer
+	err := client.RunCommand(ctx, "find device", 0, func(session *ssh.Session) error {
+		session.Stdout = &out
+		return session.Run(fmt.Sprintf(deviceScript, serial, xen))
+	})
+	device := strings.TrimSpace(out.String())
+	if err != nil || !strings.HasPrefix(device, "/dev/") {
+		return "", fmt.Errorf("volume %s not found on the bootstrap machine: %v", volumeID, err)
+	}
+	return device, nil
+}
@@ -0,0 +1,54 @@
+package ami
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/amdonov/ami-builder/instance"
+)
+
+// Manifest describes a registered AMI and how it was built.
+type Manifest struct {
+	BuildID      string
+	Name         string
+	ImageID      string
+	Architecture string
+	BootMode     string
+	SnapshotID   string
+	InstanceType string
+	Market       string
+	// Copies maps each region the image was copied to to its ID there
+	Copies map[string]string
+}
+
+// ManifestPath returns the file the build's manifest is written to, next to
+// its state file in the build directory.
+func (s *State) ManifestPath() string {
+	return filepath.Join(filepath.Dir(s.path), "manifest.json")
+}
+
+// writeManifest records the result of a finished build.
+func writeManifest(state *State) error {
+	manifest := &Manifest{
+		BuildID:      state.BuildID,
+		Name:         state.Name,
+		ImageID:      state.ImageID,
+		Architecture: instance.Architecture(state.Architecture),
+		BootMode:     state.Features.WithDefaults(state.Architecture).BootMode,
+		SnapshotID:   state.SnapshotID,
+		InstanceType: state.InstanceType,
+		Market:       state.Market,
+	}
+	for _, c := range state.Copies {
+		if manifest.Copies == nil {
+			manifest.Copies = make(map[string]string)
+		}
+		manifest.Copies[c.Region] = c.ImageID
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(state.ManifestPath(), data, 0644)
+}
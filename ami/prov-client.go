@@ -1,15 +1,10 @@
 package ami
 
 import (
+	"context"
 	"fmt"
-	"os"
 
-	"golang.org/x/crypto/ssh"
-
-	"github.com/amdonov/ami-builder/instance"
 	myssh "github.com/amdonov/ami-builder/ssh"
-
-	"github.com/tmc/scp"
 )
 
 type provClient struct {
@@ -19,30 +14,25 @@ type provClient struct {
 	repo   string
 }
 
-func NewProvClientProvisioner(user, rpm, server, repo string) instance.Provisioner {
+func NewProvClientProvisioner(user, rpm, server, repo string) Provisioner {
 	return &provClient{user, rpm, server, repo}
 }
 
-func (c *provClient) Provision(ip string, key []byte) error {
-	client, err := myssh.Connect(c.user, ip, key)
+func (c *provClient) Provision(ctx context.Context, host *myssh.Host, volumeID, bootMode string) error {
+	client, err := myssh.Connect(ctx, c.user, host)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
-	err = client.RunCommand(func(session *ssh.Session) error {
-		return scp.CopyPath(c.rpm, "/tmp/prov-client.rpm", session)
-	})
+	device, err := findDevice(ctx, client, volumeID)
 	if err != nil {
 		return err
 	}
-	err = client.RunCommand(func(session *ssh.Session) error {
-		return scp.CopyPath("ami-iaas.sh", "~/ami.sh", session)
-	})
-	if err != nil {
+	if err = client.Upload(ctx, c.rpm, "/tmp/prov-client.rpm"); err != nil {
+		return err
+	}
+	if err = client.Upload(ctx, "ami-iaas.sh", "~/ami.sh"); err != nil {
 		return err
 	}
-	return client.RunCommand(func(session *ssh.Session) error {
-		session.Stdout = os.Stdout
-		return session.Run(fmt.Sprintf("sudo /bin/bash ./ami.sh %s %s", c.server, c.repo))
-	})
+	return client.Run(ctx, "ami.sh", fmt.Sprintf("sudo /bin/bash ./ami.sh %s %s %s %s", c.server, c.repo, device, bootMode))
 }
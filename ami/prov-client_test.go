@@ -0,0 +1,31 @@
+package ami
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestProvClientProvision(t *testing.T) {
+	inTempDir(t)
+	ioutil.WriteFile("ami-iaas.sh", []byte("#!/bin/bash\n"), 0644)
+	ioutil.WriteFile("provision-client.rpm", []byte("rpm"), 0644)
+	server, host := sshHost(t)
+	server.Respond("lsblk", 0, "/dev/nvme1n1\n", "")
+	p := NewProvClientProvisioner("centos", "provision-client.rpm", "172.31.32.198", "default")
+	if err := p.Provision(context.Background(), host, "vol-1", "legacy-bios"); err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles := map[string][]byte{
+		"/tmp/prov-client.rpm": []byte("rpm"),
+		"/home/centos/ami.sh":  []byte("#!/bin/bash\n"),
+	}
+	if files := server.Files(); !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("expected %q, got %q", expectedFiles, files)
+	}
+	expected := []string{"sudo /bin/bash ./ami.sh 172.31.32.198 default /dev/nvme1n1 legacy-bios"}
+	if commands := server.Commands(); !reflect.DeepEqual(commands[1:], expected) {
+		t.Errorf("expected %q, got %q", expected, commands)
+	}
+}
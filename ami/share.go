@@ -0,0 +1,97 @@
+package ami
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/amdonov/ami-builder/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Share lets the accounts and organizations in sharing launch imageID. The
+// accounts may also create volumes from its snapshots, which they need for
+// encrypted images. Snapshots can't be shared with organizations, which use
+// them through the image.
+func Share(ctx context.Context, ec2Service ec2iface.EC2API, imageID string, sharing instance.Sharing) error {
+	return modifySharing(ctx, ec2Service, imageID, sharing, true)
+}
+
+// Unshare removes what Share granted.
+func Unshare(ctx context.Context, ec2Service ec2iface.EC2API, imageID string, sharing instance.Sharing) error {
+	return modifySharing(ctx, ec2Service, imageID, sharing, false)
+}
+
+func modifySharing(ctx context.Context, ec2Service ec2iface.EC2API, imageID string, sharing instance.Sharing, add bool) error {
+	if err := sharing.Validate(); err != nil {
+		return err
+	}
+	if sharing.Empty() {
+		return fmt.Errorf("no accounts or organizations to share %s with", imageID)
+	}
+	images, err := ec2Service.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(imageID)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(images.Images) == 0 {
+		return fmt.Errorf("AMI %s not found", imageID)
+	}
+
+	var launch []*ec2.LaunchPermission
+	var volume []*ec2.CreateVolumePermission
+	for _, account := range sharing.Accounts {
+		launch = append(launch, &ec2.LaunchPermission{UserId: aws.String(account)})
+		volume = append(volume, &ec2.CreateVolumePermission{UserId: aws.String(account)})
+	}
+	for _, arn := range sharing.OrgARNs {
+		if instance.IsOU(arn) {
+			launch = append(launch, &ec2.LaunchPermission{OrganizationalUnitArn: aws.String(arn)})
+		} else {
+			launch = append(launch, &ec2.LaunchPermission{OrganizationArn: aws.String(arn)})
+		}
+	}
+	launchChanges := &ec2.LaunchPermissionModifications{}
+	volumeChanges := &ec2.CreateVolumePermissionModifications{}
+	if add {
+		launchChanges.Add = launch
+		volumeChanges.Add = volume
+	} else {
+		launchChanges.Remove = launch
+		volumeChanges.Remove = volume
+	}
+
+	_, err = ec2Service.ModifyImageAttributeWithContext(ctx, &ec2.ModifyImageAttributeInput{
+		ImageId:          aws.String(imageID),
+		LaunchPermission: launchChanges,
+	})
+	if err != nil {
+		return err
+	}
+	if len(volume) > 0 {
+		for _, mapping := range images.Images[0].BlockDeviceMappings {
+			if mapping.Ebs == nil || mapping.Ebs.SnapshotId == nil {
+				continue
+			}
+			_, err = ec2Service.ModifySnapshotAttributeWithContext(ctx, &ec2.ModifySnapshotAttributeInput{
+				SnapshotId:             mapping.Ebs.SnapshotId,
+				Attribute:              aws.String(ec2.SnapshotAttributeNameCreateVolumePermission),
+				CreateVolumePermission: volumeChanges,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	with := strings.Join(append(append([]string(nil), sharing.Accounts...), sharing.OrgARNs...), ", ")
+	if add {
+		log.Printf("Shared %s with %s", imageID, with)
+	} else {
+		log.Printf("Stopped sharing %s with %s", imageID, with)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package ami
+
+import (
+	"context"
+	"testing"
+
+	"github.com/amdonov/ami-builder/instance"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestShareAndUnshare(t *testing.T) {
+	inTempDir(t)
+	f, config := newFake()
+	if err := CreateAMI(context.Background(), f, config, &provisioner{}); err != nil {
+		t.Fatal(err)
+	}
+	var imageID, snapshotID string
+	for id, image := range f.Images {
+		imageID, snapshotID = id, aws.StringValue(image.BlockDeviceMappings[0].Ebs.SnapshotId)
+	}
+	sharing := instance.Sharing{
+		Accounts: []string{"111122223333", "444455556666"},
+		OrgARNs:  []string{"arn:aws:organizations::123456789012:ou/o-a1b2c3d4e5/ou-ab12-cdef3456"},
+	}
+	if err := Share(context.Background(), f, imageID, sharing); err != nil {
+		t.Fatal(err)
+	}
+	launch := f.LaunchPermissions[imageID]
+	if len(launch) != 3 || aws.StringValue(launch[2].OrganizationalUnitArn) != sharing.OrgARNs[0] {
+		t.Errorf("launch permissions %v", launch)
+	}
+	if volume := f.VolumePermissions[snapshotID]; len(volume) != 2 {
+		t.Errorf("volume permissions %v", volume)
+	}
+
+	sharing.Accounts = sharing.Accounts[1:]
+	if err := Unshare(context.Background(), f, imageID, sharing); err != nil {
+		t.Fatal(err)
+	}
+	if launch = f.LaunchPermissions[imageID]; len(launch) != 1 || aws.StringValue(launch[0].UserId) != "111122223333" {
+		t.Errorf("launch permissions %v", launch)
+	}
+	if volume := f.VolumePermissions[snapshotID]; len(volume) != 1 || aws.StringValue(volume[0].UserId) != "111122223333" {
+		t.Errorf("volume permissions %v", volume)
+	}
+}
+
+func TestShareRejectsInvalidInput(t *testing.T) {
+	f, _ := newFake()
+	invalid := []instance.Sharing{
+		{},
+		{Accounts: []string{"1234"}},
+		{OrgARNs: []string{"o-a1b2c3d4e5"}},
+	}
+	for _, sharing := range invalid {
+		if err := Share(context.Background(), f, "ami-1", sharing); err == nil {
+			t.Errorf("%+v: expected an error", sharing)
+		}
+	}
+	if len(f.Calls) != 0 {
+		t.Errorf("AWS called before validation: %v", f.Calls)
+	}
+	if err := Share(context.Background(), f, "ami-missing", instance.Sharing{Accounts: []string{"111122223333"}}); err == nil {
+		t.Error("expected an error for a missing image")
+	}
+}
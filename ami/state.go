@@ -0,0 +1,97 @@
+package ami
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/amdonov/ami-builder/instance"
+)
+
+// Build phases recorded in the state file
+const (
+	Provisioned   = "provisioned"
+	CleanedUp     = "cleaned-up"
+	Snapshotted   = "snapshotted"
+	VolumeDeleted = "volume-deleted"
+	Registered    = "registered"
+	Copied        = "copied"
+	Shared        = "shared"
+)
+
+// State records the progress of an AMI build so a failed build can be
+// resumed from the last completed phase.
+type State struct {
+	BuildID         string
+	Name            string
+	Family          string
+	InstanceID      string
+	InstanceType    string
+	Market          string
+	KeyFile         string
+	SecurityGroupID string
+	Architecture    string
+	// Region is where the image is built and Copies where it's copied to
+	Region  string
+	Copies  []instance.Copy
+	Sharing instance.Sharing
+	// Storage is also used to register the image
+	Storage    instance.Storage
+	Features   instance.Features
+	VolumeID   string
+	SnapshotID string
+	ImageID    string
+	Phases     []string
+	path       string
+}
+
+// LoadState reads a state file written by a previous build.
+func LoadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &State{path: path}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Path returns the file the state is saved to.
+func (s *State) Path() string {
+	return s.path
+}
+
+// Done reports whether phase has completed.
+func (s *State) Done(phase string) bool {
+	for _, p := range s.Phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete marks phase as completed and saves the state.
+func (s *State) Complete(phase string) error {
+	if !s.Done(phase) {
+		s.Phases = append(s.Phases, phase)
+	}
+	return s.Save()
+}
+
+// Save writes the state to its file.
+func (s *State) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, data, 0600)
+}
+
+// Remove deletes the state file. The private key is left for troubleshooting
+// and removed when the bootstrap instance is cleaned up.
+func (s *State) Remove() error {
+	return os.Remove(s.path)
+}
@@ -0,0 +1,51 @@
+package ami
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/amdonov/ami-builder/instance"
+)
+
+func TestStateSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	state := &State{
+		BuildID:  "bootstrap-1",
+		Name:     "test image",
+		VolumeID: "vol-1",
+		Storage:  instance.Storage{Size: 40, Type: "gp3"},
+		path:     filepath.Join(dir, "state.json"),
+	}
+	if err := state.Complete(Provisioned); err != nil {
+		t.Fatal(err)
+	}
+	// Completing a phase twice records it once
+	if err := state.Complete(Provisioned); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(state.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("state file mode is %v", info.Mode())
+	}
+	loaded, err := LoadState(state.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, state) {
+		t.Errorf("expected %+v, got %+v", state, loaded)
+	}
+	if !loaded.Done(Provisioned) || loaded.Done(CleanedUp) || len(loaded.Phases) != 1 {
+		t.Errorf("unexpected phases %v", loaded.Phases)
+	}
+	if err = loaded.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadState(state.Path()); !os.IsNotExist(err) {
+		t.Errorf("state file not removed: %v", err)
+	}
+}
@@ -1,20 +1,19 @@
 package ansible
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"os"
-
-	"golang.org/x/crypto/ssh"
+	"log"
 
 	"github.com/amdonov/ami-builder/instance"
 	myssh "github.com/amdonov/ami-builder/ssh"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/iam"
-	"github.com/tmc/scp"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
 )
 
 type ansible struct {
@@ -36,8 +35,8 @@ func NewAnsibleProvisioner(tag, user, clientRPM, serverRPM, ami, dns, organizati
 	return &ansible{tag, user, clientRPM, serverRPM, ami, dns, organization, realm, domain, password, role, repo}
 }
 
-func (c *ansible) Provision(ip string, key []byte) error {
-	client, err := myssh.Connect(c.user, ip, key)
+func (c *ansible) Provision(ctx context.Context, host *myssh.Host) error {
+	client, err := myssh.Connect(ctx, c.user, host)
 	if err != nil {
 		return err
 	}
@@ -48,29 +47,17 @@ func (c *ansible) Provision(ip string, key []byte) error {
 
 	files["server.sh"] = "~/server.sh"
 	for src, dest := range files {
-		err = client.RunCommand(func(session *ssh.Session) error {
-			return scp.CopyPath(src, dest, session)
-		})
-		if err != nil {
+		if err = client.Upload(ctx, src, dest); err != nil {
 			return err
 		}
 	}
-	return client.RunCommand(func(session *ssh.Session) error {
-		session.Stdout = os.Stdout
-		return session.Run(fmt.Sprintf("/bin/bash ./server.sh %s %s %s %s %s %s %s %s %s %s",
-			c.password, c.domain, c.realm, c.organization, c.dns, c.ami, c.user, c.role, c.repo, c.tag))
-	})
+	return client.Run(ctx, "server.sh", fmt.Sprintf("/bin/bash ./server.sh %s %s %s %s %s %s %s %s %s %s",
+		c.password, c.domain, c.realm, c.organization, c.dns, c.ami, c.user, c.role, c.repo, c.tag))
 }
 
-func makeRole(sess *session.Session, iamEndpoint, role string) error {
-	var svc *iam.IAM
-	if iamEndpoint == "" {
-		svc = iam.New(sess)
-	} else {
-		svc = iam.New(sess, &aws.Config{Endpoint: aws.String(iamEndpoint)})
-	}
+func makeRole(ctx context.Context, svc iamiface.IAMAPI, role string) error {
 	awsRole := aws.String(role)
-	_, err := svc.CreateInstanceProfile(&iam.CreateInstanceProfileInput{
+	_, err := svc.CreateInstanceProfileWithContext(ctx, &iam.CreateInstanceProfileInput{
 		InstanceProfileName: awsRole,
 	})
 	if err != nil {
@@ -84,21 +71,21 @@ func makeRole(sess *session.Session, iamEndpoint, role string) error {
 		AssumeRolePolicyDocument: aws.String("{\"Version\":\"2012-10-17\",\"Statement\":[{\"Effect\":\"Allow\",\"Principal\":{\"Service\":\"ec2.amazonaws.com\"},\"Action\":\"sts:AssumeRole\"}]}"), // Required
 		RoleName:                 awsRole,
 	}
-	_, err = svc.CreateRole(params)
+	_, err = svc.CreateRoleWithContext(ctx, params)
 	if err != nil {
 		if err.(awserr.Error).Code() == "EntityAlreadyExists" {
 			return nil
 		}
 		return err
 	}
-	_, err = svc.AddRoleToInstanceProfile(&iam.AddRoleToInstanceProfileInput{
+	_, err = svc.AddRoleToInstanceProfileWithContext(ctx, &iam.AddRoleToInstanceProfileInput{
 		InstanceProfileName: awsRole,
 		RoleName:            awsRole,
 	})
 	if err != nil {
 		return err
 	}
-	_, err = svc.PutRolePolicy(&iam.PutRolePolicyInput{
+	_, err = svc.PutRolePolicyWithContext(ctx, &iam.PutRolePolicyInput{
 		PolicyDocument: aws.String("{\"Version\":\"2012-10-17\",\"Statement\":[{\"Effect\":\"Allow\",\"Action\":[\"ec2:*\"],\"Resource\":[\"*\"]},{\"Effect\":\"Allow\",\"Action\":[\"iam:PassRole\"],\"Resource\":[\"*\"]}]}"),
 		PolicyName:     aws.String("anything-in-ec2"),
 		RoleName:       awsRole,
@@ -106,32 +93,48 @@ func makeRole(sess *session.Session, iamEndpoint, role string) error {
 	return err
 }
 
-func CreateProvisionServer(ec2Endpoint, iamEndpoint string, config *instance.Config, provisioner instance.Provisioner) error {
-	if "" == config.Subnet {
+func CreateProvisionServer(ctx context.Context, ec2Service ec2iface.EC2API, iamService iamiface.IAMAPI, config *instance.Config, provisioner instance.Provisioner) (err error) {
+	if len(config.Subnets) == 0 {
 		return errors.New("subnet is required")
 	}
-	sess, err := session.NewSession()
-	if err != nil {
-		return err
+	// server.sh's ec2_facts and the Ansible EC2 modules use IMDSv1
+	if config.BootstrapIMDS == ec2.HttpTokensStateRequired {
+		return errors.New("the provision server can't require IMDSv2, use --bootstrap-imds optional")
+	}
+	// An existing instance profile is used as is
+	if config.InstanceProfile == "" {
+		err = makeRole(ctx, iamService, config.IAMRole)
+		if err != nil {
+			return err
+		}
 	}
-	err = makeRole(sess, iamEndpoint, config.IAMRole)
+
+	// Tear down anything left behind if the build fails
+	journal := &instance.Journal{}
+	var i *instance.Server
+	defer func() {
+		if err != nil {
+			if rbErr := journal.Rollback(ec2Service); rbErr != nil {
+				log.Println(rbErr)
+			}
+			if i != nil && i.KeyFile != "" {
+				log.Printf("Bootstrap private key kept in %s", i.KeyFile)
+			}
+		}
+	}()
+
+	i, err = instance.Start(ctx, ec2Service, config, journal)
 	if err != nil {
 		return err
 	}
-	var ec2Service *ec2.EC2
-	if ec2Endpoint == "" {
-		ec2Service = ec2.New(sess)
-	} else {
-		ec2Service = ec2.New(sess, &aws.Config{Endpoint: aws.String(ec2Endpoint)})
-	}
-
-	i, err := instance.Start(ec2Service, config)
+	buildLog, err := i.OpenLog()
 	if err != nil {
 		return err
 	}
-	err = provisioner.Provision(i.IPAddress, i.Key)
+	defer buildLog.Close()
+	err = provisioner.Provision(ctx, i.Host())
 	if err != nil {
 		return err
 	}
-	return instance.CleanUp(ec2Service, i)
+	return instance.CleanUp(ctx, ec2Service, i)
 }
@@ -0,0 +1,99 @@
+package ansible
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/amdonov/ami-builder/instance"
+	myssh "github.com/amdonov/ami-builder/ssh"
+)
+
+func TestMakeRole(t *testing.T) {
+	f := fake.NewIAM()
+	if err := makeRole(context.Background(), f, "ansible"); err != nil {
+		t.Fatal(err)
+	}
+	profile, ok := f.InstanceProfiles["ansible"]
+	if !ok || len(profile.Roles) != 1 {
+		t.Fatalf("instance profile not created with role: %v", f.InstanceProfiles)
+	}
+	if _, ok := f.RolePolicies["ansible"]["anything-in-ec2"]; !ok {
+		t.Error("role policy not attached")
+	}
+	// Existing roles are reused
+	if err := makeRole(context.Background(), f, "ansible"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// inTempDir runs the test from an empty directory holding files.
+func inTempDir(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	for name, content := range files {
+		if err = ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCreateProvisionServerNeedsIMDSv1(t *testing.T) {
+	f := fake.NewEC2()
+	err := CreateProvisionServer(context.Background(), f, fake.NewIAM(), &instance.Config{
+		Subnets:       []string{"subnet-1"},
+		BootstrapIMDS: "required",
+	}, nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(f.Calls) != 0 {
+		t.Errorf("AWS called before validation: %v", f.Calls)
+	}
+}
+
+func TestProvision(t *testing.T) {
+	inTempDir(t, map[string]string{
+		"server.sh":  "#!/bin/bash\n",
+		"server.rpm": "server",
+		"client.rpm": "client",
+	})
+
+	private, public, err := instance.GenerateKey(instance.ED25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := fake.NewSSH(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	p := NewAnsibleProvisioner("ami-builder", "centos", "client.rpm", "server.rpm", "ami-base", "10.0.0.2",
+		"example", "EXAMPLE.COM", "example.com", "secret", "ansible", "default")
+	err = p.Provision(context.Background(), &myssh.Host{Address: server.Addr, Key: private, Fingerprints: []string{server.Fingerprint}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles := map[string][]byte{
+		"/tmp/prov-server.rpm":   []byte("server"),
+		"/tmp/prov-client.rpm":   []byte("client"),
+		"/home/centos/server.sh": []byte("#!/bin/bash\n"),
+	}
+	if files := server.Files(); !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("expected %q, got %q", expectedFiles, files)
+	}
+	expected := []string{"/bin/bash ./server.sh secret example.com EXAMPLE.COM example 10.0.0.2 ami-base centos ansible default ami-builder"}
+	if commands := server.Commands(); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %q, got %q", expected, commands)
+	}
+}
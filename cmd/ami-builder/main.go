@@ -1,16 +1,31 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/amdonov/ami-builder/ami"
 	"github.com/amdonov/ami-builder/ansible"
+	"github.com/amdonov/ami-builder/gc"
+	"github.com/amdonov/ami-builder/prune"
 
 	"encoding/base64"
 
 	"github.com/amdonov/ami-builder/instance"
+	myssh "github.com/amdonov/ami-builder/ssh"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
@@ -24,7 +39,173 @@ resolv_conf:
     rotate: true
     timeout: 1`
 
+// newServices creates EC2 and IAM clients, honoring any endpoint overrides.
+func newServices(c *cli.Context) (*ec2.EC2, *iam.IAM, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	ec2Config := &aws.Config{}
+	if endpoint := c.GlobalString("ec2"); endpoint != "" {
+		ec2Config.Endpoint = aws.String(endpoint)
+	}
+	iamConfig := &aws.Config{}
+	if endpoint := c.GlobalString("iam"); endpoint != "" {
+		iamConfig.Endpoint = aws.String(endpoint)
+	}
+	return ec2.New(sess, ec2Config), iam.New(sess, iamConfig), nil
+}
+
+// newRegional returns the build's region and creates EC2 clients for others,
+// honoring any endpoint override.
+func newRegional(c *cli.Context) (string, instance.Regional, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return "", nil, err
+	}
+	endpoint := c.GlobalString("ec2")
+	return aws.StringValue(sess.Config.Region), func(region string) ec2iface.EC2API {
+		config := &aws.Config{Region: aws.String(region)}
+		if endpoint != "" {
+			config.Endpoint = aws.String(endpoint)
+		}
+		return ec2.New(sess, config)
+	}, nil
+}
+
+// candidates splits a comma separated list of choices in order of preference.
+func candidates(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// newConfig builds the bootstrap instance configuration shared by every build.
+func newConfig(c *cli.Context) (*instance.Config, error) {
+	config := &instance.Config{
+		Subnets:          candidates(c.GlobalString("subnet")),
+		Name:             c.GlobalString("name"),
+		Family:           c.GlobalString("family"),
+		BootstrapIMDS:    c.GlobalString("bootstrap-imds"),
+		ImageID:          c.GlobalString("ami"),
+		Sizes:            candidates(c.GlobalString("size")),
+		Arch:             c.GlobalString("arch"),
+		Private:          c.GlobalBool("private"),
+		SSHCIDRs:         c.GlobalStringSlice("ssh-cidr"),
+		SecurityGroupIDs: c.GlobalStringSlice("security-group"),
+		KeyName:          c.GlobalString("key-name"),
+		KeyFile:          c.GlobalString("key-file"),
+		KeyType:          c.GlobalString("key-type"),
+		WorkDir:          c.GlobalString("work-dir"),
+		InstanceProfile:  c.GlobalString("instance-profile"),
+		Spot:             c.GlobalBool("spot"),
+		SpotMaxPrice:     c.GlobalString("spot-max-price"),
+		SkipHostKeyCheck: c.GlobalBool("skip-host-key-check"),
+		SSHTimeouts: myssh.Timeouts{
+			Connect:      c.GlobalDuration("ssh-timeout"),
+			Dial:         c.GlobalDuration("ssh-dial-timeout"),
+			Handshake:    c.GlobalDuration("ssh-handshake-timeout"),
+			AuthAttempts: c.GlobalInt("ssh-auth-attempts"),
+			KeepAlive:    c.GlobalDuration("ssh-keepalive"),
+			KeepAliveMax: c.GlobalInt("ssh-keepalive-max"),
+			Command:      c.GlobalDuration("command-timeout"),
+		},
+		Storage: instance.Storage{
+			Size:       int64(c.GlobalInt("volume-size")),
+			Type:       c.GlobalString("volume-type"),
+			IOPS:       int64(c.GlobalInt("volume-iops")),
+			Throughput: int64(c.GlobalInt("volume-throughput")),
+			Encrypted:  c.GlobalBool("encrypted"),
+			KMSKeyID:   c.GlobalString("kms-key-id"),
+		},
+		Features: instance.Features{
+			BootMode:        c.GlobalString("boot-mode"),
+			ImdsSupport:     c.GlobalString("imds-support"),
+			EnaSupport:      c.GlobalBool("ena-support"),
+			SriovNetSupport: c.GlobalBool("sriov-net-support"),
+		},
+		Sharing: instance.Sharing{
+			Accounts: c.GlobalStringSlice("share-with-account"),
+			OrgARNs:  c.GlobalStringSlice("share-with-org-arn"),
+		},
+	}
+	for _, spec := range c.GlobalStringSlice("copy-to-region") {
+		target, err := instance.ParseCopy(spec)
+		if err != nil {
+			return nil, err
+		}
+		config.CopyTo = append(config.CopyTo, target)
+	}
+	if len(config.CopyTo) > 0 {
+		var err error
+		if config.Region, config.Regional, err = newRegional(c); err != nil {
+			return nil, err
+		}
+		if config.Region == "" {
+			return nil, errors.New("copy-to-region requires the build's region, set with AWS_REGION")
+		}
+	}
+	if spec := c.GlobalString("bastion"); spec != "" {
+		keyFile := c.GlobalString("bastion-key")
+		if keyFile == "" {
+			return nil, errors.New("bastion-key is required with bastion")
+		}
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if config.Bastion, err = myssh.ParseBastion(spec, key); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// sharingFlags choose who the share and unshare commands apply to.
+var sharingFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "account",
+		Usage: "account ID (repeatable)",
+	},
+	cli.StringSliceFlag{
+		Name:  "org-arn",
+		Usage: "organization or organizational unit ARN (repeatable)",
+	},
+}
+
+// modifySharing runs share or unshare on the AMI given as the argument.
+func modifySharing(ctx context.Context, c *cli.Context, modify func(context.Context, ec2iface.EC2API, string, instance.Sharing) error) error {
+	if c.NArg() != 1 {
+		return errors.New("AMI id argument is required")
+	}
+	ec2Service, _, err := newServices(c)
+	if err != nil {
+		return err
+	}
+	return modify(ctx, ec2Service, c.Args().First(), instance.Sharing{
+		Accounts: c.StringSlice("account"),
+		OrgARNs:  c.StringSlice("org-arn"),
+	})
+}
+
 func main() {
+	// Cancel the build on Ctrl-C or SIGTERM so temporary resources are
+	// cleaned up. A second signal exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s. Stopping and cleaning up", sig)
+		signal.Stop(sigs)
+		cancel()
+	}()
+
 	app := cli.NewApp()
 	app.Name = "ami-builder"
 	app.Version = "0.2.0"
@@ -33,23 +214,33 @@ func main() {
 		cli.StringFlag{
 			Name:   "subnet",
 			Value:  "",
-			Usage:  "bootstrap machine subnet id",
+			Usage:  "bootstrap machine subnet id. A comma separated list is tried in order when capacity is short",
 			EnvVar: "AMI_SUBNET"},
 		cli.StringFlag{
 			Name:   "name, n",
 			Value:  "CentOS 7.3",
 			Usage:  "ami and snapshot name",
 			EnvVar: "AMI_NAME"},
+		cli.StringFlag{
+			Name:   "family",
+			Value:  "",
+			Usage:  "family the AMI is pruned with, such as the name without its version. AMIs without one are never pruned",
+			EnvVar: "AMI_FAMILY"},
 		cli.StringFlag{
 			Name:   "size, s",
 			Value:  "t2.micro",
-			Usage:  "bootstrap machine size",
+			Usage:  "bootstrap machine size. A comma separated list is tried in order when capacity is short",
 			EnvVar: "AMI_SIZE"},
 		cli.StringFlag{
 			Name:   "ami, a",
 			Value:  "ami-9be6f38c",
 			Usage:  "bootstrap machine AMI",
 			EnvVar: "AMI_IMAGE"},
+		cli.StringFlag{
+			Name:   "arch",
+			Value:  instance.X86_64,
+			Usage:  "architecture of the AMI, x86_64 or arm64. The bootstrap AMI and size must match",
+			EnvVar: "AMI_ARCH"},
 		cli.StringFlag{
 			Name:   "user, u",
 			Value:  "ec2-user",
@@ -60,6 +251,189 @@ func main() {
 			Usage:  "connect to bootstrap machine via private IP",
 			EnvVar: "AMI_PRIVATE",
 		},
+		cli.BoolFlag{
+			Name:   "spot",
+			Usage:  "run the bootstrap machine as a spot instance, falling back to on-demand",
+			EnvVar: "AMI_SPOT",
+		},
+		cli.StringFlag{
+			Name:   "spot-max-price",
+			Value:  "",
+			Usage:  "maximum hourly spot price. Defaults to the on-demand price",
+			EnvVar: "AMI_SPOT_MAX_PRICE",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-cidr",
+			Usage:  "CIDR or address allowed to SSH to the bootstrap machine (repeatable). Defaults to the VPC CIDRs with --private and the detected egress address otherwise",
+			EnvVar: "AMI_SSH_CIDR",
+		},
+		cli.StringSliceFlag{
+			Name:   "security-group",
+			Usage:  "existing security group id for the bootstrap machine (repeatable) instead of a temporary one",
+			EnvVar: "AMI_SECURITY_GROUP",
+		},
+		cli.StringFlag{
+			Name:   "key-name",
+			Value:  "",
+			Usage:  "existing key pair for the bootstrap machine instead of a temporary one. Requires --key-file",
+			EnvVar: "AMI_KEY_NAME",
+		},
+		cli.StringFlag{
+			Name:   "key-file",
+			Value:  "",
+			Usage:  "private key file for --key-name",
+			EnvVar: "AMI_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "key-type",
+			Value:  "ed25519",
+			Usage:  "type of the generated bootstrap key, ed25519 or rsa",
+			EnvVar: "AMI_KEY_TYPE",
+		},
+		cli.StringFlag{
+			Name:   "work-dir",
+			Value:  ".",
+			Usage:  "directory for per-build files such as the bootstrap private key",
+			EnvVar: "AMI_WORK_DIR",
+		},
+		cli.StringFlag{
+			Name:   "instance-profile",
+			Value:  "",
+			Usage:  "existing instance profile for the bootstrap machine",
+			EnvVar: "AMI_INSTANCE_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "bastion",
+			Value:  "",
+			Usage:  "connect to the bootstrap machine through a jump host given as user@host[:port]",
+			EnvVar: "AMI_BASTION",
+		},
+		cli.StringFlag{
+			Name:   "bastion-key",
+			Value:  "",
+			Usage:  "private key file for --bastion",
+			EnvVar: "AMI_BASTION_KEY",
+		},
+		cli.StringFlag{
+			Name:   "bootstrap-imds",
+			Value:  "optional",
+			Usage:  "required makes the bootstrap machine use IMDSv2 tokens, which its --ami must support. prov-server needs optional",
+			EnvVar: "AMI_BOOTSTRAP_IMDS",
+		},
+		cli.BoolFlag{
+			Name:   "skip-host-key-check",
+			Usage:  "trust any host key for images that don't print fingerprints to the console",
+			EnvVar: "AMI_SKIP_HOST_KEY_CHECK",
+		},
+		cli.DurationFlag{
+			Name:   "ssh-timeout",
+			Value:  myssh.DefaultTimeouts.Connect,
+			Usage:  "how long to keep trying to connect to the bootstrap machine",
+			EnvVar: "AMI_SSH_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "ssh-dial-timeout",
+			Value:  myssh.DefaultTimeouts.Dial,
+			Usage:  "timeout for each SSH connection attempt",
+			EnvVar: "AMI_SSH_DIAL_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "ssh-handshake-timeout",
+			Value:  myssh.DefaultTimeouts.Handshake,
+			Usage:  "timeout for each SSH handshake",
+			EnvVar: "AMI_SSH_HANDSHAKE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "ssh-auth-attempts",
+			Value:  myssh.DefaultTimeouts.AuthAttempts,
+			Usage:  "SSH authentication failures tolerated before giving up",
+			EnvVar: "AMI_SSH_AUTH_ATTEMPTS",
+		},
+		cli.DurationFlag{
+			Name:   "ssh-keepalive",
+			Value:  myssh.DefaultTimeouts.KeepAlive,
+			Usage:  "interval between SSH keepalives",
+			EnvVar: "AMI_SSH_KEEPALIVE",
+		},
+		cli.IntFlag{
+			Name:   "ssh-keepalive-max",
+			Value:  myssh.DefaultTimeouts.KeepAliveMax,
+			Usage:  "unanswered SSH keepalives before the connection is considered dead",
+			EnvVar: "AMI_SSH_KEEPALIVE_MAX",
+		},
+		cli.DurationFlag{
+			Name:   "command-timeout",
+			Usage:  "limit for each upload and provisioning script, no limit by default",
+			EnvVar: "AMI_COMMAND_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "volume-size",
+			Value:  int(instance.DefaultStorage.Size),
+			Usage:  "size of the AMI's root volume in GiB",
+			EnvVar: "AMI_VOLUME_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "volume-type",
+			Value:  instance.DefaultStorage.Type,
+			Usage:  "type of the AMI's root volume: gp2, gp3, io1 or io2",
+			EnvVar: "AMI_VOLUME_TYPE",
+		},
+		cli.IntFlag{
+			Name:   "volume-iops",
+			Usage:  "provisioned IOPS, required for io1 and io2",
+			EnvVar: "AMI_VOLUME_IOPS",
+		},
+		cli.IntFlag{
+			Name:   "volume-throughput",
+			Usage:  "provisioned throughput in MiB/s for gp3",
+			EnvVar: "AMI_VOLUME_THROUGHPUT",
+		},
+		cli.BoolFlag{
+			Name:   "encrypted",
+			Usage:  "encrypt the AMI's root volume",
+			EnvVar: "AMI_ENCRYPTED",
+		},
+		cli.StringFlag{
+			Name:   "kms-key-id",
+			Usage:  "KMS key to encrypt with instead of the default EBS key",
+			EnvVar: "AMI_KMS_KEY_ID",
+		},
+		cli.StringFlag{
+			Name:   "boot-mode",
+			Usage:  "boot mode of the AMI, legacy-bios or uefi. Defaults to uefi for arm64 and legacy-bios otherwise",
+			EnvVar: "AMI_BOOT_MODE",
+		},
+		cli.StringFlag{
+			Name:   "imds-support",
+			Value:  "",
+			Usage:  "v2.0 requires instances launched from the AMI to use IMDSv2. The image's cloud-init must support it",
+			EnvVar: "AMI_IMDS_SUPPORT",
+		},
+		cli.BoolFlag{
+			Name:   "ena-support",
+			Usage:  "advertise ENA enhanced networking. The image must have the ENA driver. Always on for arm64",
+			EnvVar: "AMI_ENA_SUPPORT",
+		},
+		cli.BoolFlag{
+			Name:   "sriov-net-support",
+			Usage:  "advertise Intel 82599 VF enhanced networking",
+			EnvVar: "AMI_SRIOV_NET_SUPPORT",
+		},
+		cli.StringSliceFlag{
+			Name:   "copy-to-region",
+			Usage:  "region to copy the finished AMI to (repeatable). Use region=kms-key to encrypt the copy with a key from that region",
+			EnvVar: "AMI_COPY_TO_REGION",
+		},
+		cli.StringSliceFlag{
+			Name:   "share-with-account",
+			Usage:  "account ID allowed to launch the AMI and use its snapshot (repeatable)",
+			EnvVar: "AMI_SHARE_WITH_ACCOUNT",
+		},
+		cli.StringSliceFlag{
+			Name:   "share-with-org-arn",
+			Usage:  "organization or organizational unit ARN allowed to launch the AMI (repeatable)",
+			EnvVar: "AMI_SHARE_WITH_ORG_ARN",
+		},
 		cli.StringFlag{
 			Name:   "repo, r",
 			Value:  "default",
@@ -91,14 +465,15 @@ func main() {
 				},
 			},
 			Action: func(c *cli.Context) error {
-				config := &instance.Config{
-					Subnet:  c.GlobalString("subnet"),
-					Name:    c.GlobalString("name"),
-					ImageID: c.GlobalString("ami"),
-					Size:    c.GlobalString("size"),
-					Private: c.GlobalBool("private"),
-				}
-				return ami.CreateAMI(c.GlobalString("ec2"), config, ami.NewCloudInitProvisioner(c.GlobalString("user"), c.String("newuser"), c.GlobalString("repo")))
+				config, err := newConfig(c)
+				if err != nil {
+					return err
+				}
+				ec2Service, _, err := newServices(c)
+				if err != nil {
+					return err
+				}
+				return ami.CreateAMI(ctx, ec2Service, config, ami.NewCloudInitProvisioner(c.GlobalString("user"), c.String("newuser"), c.GlobalString("repo")))
 			},
 		},
 		{
@@ -168,16 +543,17 @@ func main() {
 				if _, err := os.Stat(clientRPM); os.IsNotExist(err) {
 					return fmt.Errorf("file path %s does not exist", clientRPM)
 				}
-				config := &instance.Config{
-					Subnet:   c.GlobalString("subnet"),
-					Name:     c.GlobalString("name"),
-					ImageID:  c.GlobalString("ami"),
-					Size:     c.GlobalString("size"),
-					Private:  c.GlobalBool("private"),
-					IAMRole:  c.String("iam"),
-					UserData: base64.StdEncoding.EncodeToString(data),
+				config, err := newConfig(c)
+				if err != nil {
+					return err
 				}
-				return ansible.CreateProvisionServer(c.GlobalString("ec2"), c.GlobalString("iam"), config,
+				config.IAMRole = c.String("iam")
+				config.UserData = base64.StdEncoding.EncodeToString(data)
+				ec2Service, iamService, err := newServices(c)
+				if err != nil {
+					return err
+				}
+				return ansible.CreateProvisionServer(ctx, ec2Service, iamService, config,
 					ansible.NewAnsibleProvisioner(c.String("tag"), c.GlobalString("user"), clientRPM, serverRPM,
 						c.GlobalString("ami"), c.String("dns"), c.String("org"), c.String("realm"),
 						c.String("domain"), c.String("password"), c.String("iam"), c.GlobalString("repo")))
@@ -217,17 +593,113 @@ func main() {
 				if _, err := os.Stat(rpm); os.IsNotExist(err) {
 					return fmt.Errorf("file path %s does not exist", rpm)
 				}
-				config := &instance.Config{
-					Subnet:   c.GlobalString("subnet"),
-					Name:     c.GlobalString("name"),
-					ImageID:  c.GlobalString("ami"),
-					Size:     c.GlobalString("size"),
-					Private:  c.GlobalBool("private"),
-					UserData: base64.StdEncoding.EncodeToString(data),
+				config, err := newConfig(c)
+				if err != nil {
+					return err
+				}
+				config.UserData = base64.StdEncoding.EncodeToString(data)
+				ec2Service, _, err := newServices(c)
+				if err != nil {
+					return err
 				}
-				return ami.CreateAMI(c.GlobalString("ec2"), config, ami.NewProvClientProvisioner(c.GlobalString("user"), rpm, server, c.GlobalString("repo")))
+				return ami.CreateAMI(ctx, ec2Service, config, ami.NewProvClientProvisioner(c.GlobalString("user"), rpm, server, c.GlobalString("repo")))
 			},
 		},
+		{
+			Name:      "resume",
+			Usage:     "resume a failed AMI build from its state file",
+			ArgsUsage: "<state-file>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return errors.New("state file argument is required")
+				}
+				ec2Service, _, err := newServices(c)
+				if err != nil {
+					return err
+				}
+				_, regional, err := newRegional(c)
+				if err != nil {
+					return err
+				}
+				return ami.Resume(ctx, ec2Service, regional, c.Args().First())
+			},
+		},
+		{
+			Name:      "share",
+			Usage:     "share an AMI and its snapshot with accounts and organizations",
+			ArgsUsage: "<ami-id>",
+			Flags:     sharingFlags,
+			Action: func(c *cli.Context) error {
+				return modifySharing(ctx, c, ami.Share)
+			},
+		},
+		{
+			Name:      "unshare",
+			Usage:     "stop sharing an AMI and its snapshot with accounts and organizations",
+			ArgsUsage: "<ami-id>",
+			Flags:     sharingFlags,
+			Action: func(c *cli.Context) error {
+				return modifySharing(ctx, c, ami.Unshare)
+			},
+		},
+		{
+			Name:  "gc",
+			Usage: "remove resources left behind by failed builds",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "age",
+					Value: 24 * time.Hour,
+					Usage: "only remove resources older than this",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "list resources without removing them",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				ec2Service, _, err := newServices(c)
+				if err != nil {
+					return err
+				}
+				return gc.Collect(ctx, ec2Service, c.Duration("age"), c.Bool("dry-run"))
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "deregister old AMIs and delete their snapshots",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "family",
+					Value: "",
+					Usage: "only prune this family. Every family is pruned by default",
+				},
+				cli.IntFlag{
+					Name:  "keep",
+					Usage: "number of the newest AMIs to keep in each family",
+				},
+				cli.DurationFlag{
+					Name:  "age",
+					Usage: "keep AMIs younger than this",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "list AMIs without removing them",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				ec2Service, _, err := newServices(c)
+				if err != nil {
+					return err
+				}
+				return prune.Prune(ctx, ec2Service, prune.Policy{
+					Family: c.String("family"),
+					Keep:   c.Int("keep"),
+					MaxAge: c.Duration("age"),
+				}, c.Bool("dry-run"))
+			},
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
 	}
-	app.Run(os.Args)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/amdonov/ami-builder/fake"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func main() {
+	// Stop serving on Ctrl-C or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		cancel()
+	}()
+
+	app := cli.NewApp()
+	app.Name = "fake-aws"
+	app.Version = "0.2.0"
+	app.Usage = "serve an in-memory EC2 and IAM stand-in for end-to-end testing of ami-builder"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen",
+			Value: "127.0.0.1:8080",
+			Usage: "address to listen on",
+		},
+		cli.StringSliceFlag{
+			Name:  "subnet",
+			Usage: "subnet id to make available (repeatable)",
+		},
+		cli.StringFlag{
+			Name:  "public-ip",
+			Value: "",
+			Usage: "address reported for instances with a public IP",
+		},
+		cli.StringFlag{
+			Name:  "console-output",
+			Value: "",
+			Usage: "file served as the console output of every instance",
+		},
+	}
+	app.Action = func(c *cli.Context) error {
+		ec2Fake := fake.NewEC2()
+		ec2Fake.PublicIP = c.String("public-ip")
+		if file := c.String("console-output"); file != "" {
+			output, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			ec2Fake.ConsoleOutput = string(output)
+		}
+		subnets := c.StringSlice("subnet")
+		if len(subnets) == 0 {
+			subnets = []string{"subnet-fake"}
+		}
+		for _, subnet := range subnets {
+			ec2Fake.AddSubnet(subnet, "vpc-fake", ec2Fake.Region+"a")
+		}
+		server := &http.Server{
+			Addr:    c.String("listen"),
+			Handler: fake.NewServer(ec2Fake, fake.NewIAM()),
+		}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		log.Printf("Serving fake EC2 and IAM on http://%s", server.Addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,1237 @@
+package fake
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"golang.org/x/crypto/ssh"
+)
+
+// EC2 is an in-memory stand-in for the EC2 API. It keeps track of the
+// resources created through it so tests can exercise whole builds offline.
+// Calling a method it doesn't implement panics.
+type EC2 struct {
+	ec2iface.EC2API
+
+	mu     sync.Mutex
+	Region string
+	// PublicIP, when set, is the address given to every instance with a
+	// public IP so a build can reach a local SSH server
+	PublicIP string
+	// ConsoleOutput is the serial console of every running instance. It
+	// defaults to cloud-init's host key fingerprints block.
+	ConsoleOutput  string
+	KeyPairs       map[string]*ec2.KeyPairInfo
+	Vpcs           map[string]*ec2.Vpc
+	Subnets        map[string]*ec2.Subnet
+	SecurityGroups map[string]*ec2.SecurityGroup
+	Instances      map[string]*ec2.Instance
+	Volumes        map[string]*ec2.Volume
+	Snapshots      map[string]*ec2.Snapshot
+	Images         map[string]*ec2.Image
+	// BaseImages are public images the account doesn't own. Any other image
+	// ID not in Images is described as a public x86_64 image.
+	BaseImages map[string]*ec2.Image
+	// LaunchPermissions and VolumePermissions list who images and
+	// snapshots are shared with
+	LaunchPermissions map[string][]*ec2.LaunchPermission
+	VolumePermissions map[string][]*ec2.CreateVolumePermission
+	// LaunchTemplates holds the versions of each launch template by ID
+	LaunchTemplates map[string][]*ec2.LaunchTemplateVersion
+	// Calls lists the name of every action invoked, in order
+	Calls  []string
+	errors map[string][]error
+	nextID int
+}
+
+// ConsoleFingerprint is the host key fingerprint in the default console output.
+const ConsoleFingerprint = "SHA256:2pDfAUkRqPIg4ZMSdsOFjlQ/aMVyPsMzTyDdThyV2Os"
+
+const defaultConsoleOutput = `[  OK  ] Started Initial cloud-init job (metadata service crawler).
+ec2: #############################################################
+ec2: -----BEGIN SSH HOST KEY FINGERPRINTS-----
+ec2: 256 ` + ConsoleFingerprint + ` root@ip-10-0-0-4 (ED25519)
+ec2: -----END SSH HOST KEY FINGERPRINTS-----
+ec2: #############################################################
+`
+
+// NewEC2 returns an empty fake. Add subnets with AddSubnet before starting instances.
+func NewEC2() *EC2 {
+	return &EC2{
+		Region:            "us-east-1",
+		ConsoleOutput:     defaultConsoleOutput,
+		KeyPairs:          make(map[string]*ec2.KeyPairInfo),
+		Vpcs:              make(map[string]*ec2.Vpc),
+		Subnets:           make(map[string]*ec2.Subnet),
+		SecurityGroups:    make(map[string]*ec2.SecurityGroup),
+		Instances:         make(map[string]*ec2.Instance),
+		Volumes:           make(map[string]*ec2.Volume),
+		Snapshots:         make(map[string]*ec2.Snapshot),
+		Images:            make(map[string]*ec2.Image),
+		BaseImages:        make(map[string]*ec2.Image),
+		LaunchPermissions: make(map[string][]*ec2.LaunchPermission),
+		VolumePermissions: make(map[string][]*ec2.CreateVolumePermission),
+		LaunchTemplates:   make(map[string][]*ec2.LaunchTemplateVersion),
+		errors:            make(map[string][]error),
+	}
+}
+
+// AddSubnet registers a subnet in the given VPC and availability zone. The
+// VPC is created with a 10.0.0.0/16 block if it doesn't exist.
+func (f *EC2) AddSubnet(id, vpcID, az string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.Vpcs[vpcID]; !ok {
+		f.Vpcs[vpcID] = &ec2.Vpc{
+			VpcId:     aws.String(vpcID),
+			CidrBlock: aws.String("10.0.0.0/16"),
+			CidrBlockAssociationSet: []*ec2.VpcCidrBlockAssociation{
+				{CidrBlock: aws.String("10.0.0.0/16")},
+			},
+		}
+	}
+	f.Subnets[id] = &ec2.Subnet{
+		SubnetId:         aws.String(id),
+		VpcId:            aws.String(vpcID),
+		AvailabilityZone: aws.String(az),
+		CidrBlock:        aws.String("10.0.0.0/24"),
+	}
+}
+
+// Settle moves every pending instance, volume and snapshot to its steady
+// state, as EC2 would eventually do on its own.
+func (f *EC2) Settle() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, i := range f.Instances {
+		if aws.StringValue(i.State.Name) == ec2.InstanceStateNamePending {
+			i.State.Name = aws.String(ec2.InstanceStateNameRunning)
+		}
+	}
+	for _, v := range f.Volumes {
+		if aws.StringValue(v.State) == ec2.VolumeStateCreating {
+			v.State = aws.String(ec2.VolumeStateAvailable)
+		}
+		for _, attachment := range v.Attachments {
+			if aws.StringValue(attachment.State) == ec2.VolumeAttachmentStateAttaching {
+				attachment.State = aws.String(ec2.VolumeAttachmentStateAttached)
+			}
+		}
+	}
+	for _, s := range f.Snapshots {
+		if aws.StringValue(s.State) == ec2.SnapshotStatePending {
+			s.State = aws.String(ec2.SnapshotStateCompleted)
+		}
+	}
+	for _, image := range f.Images {
+		if aws.StringValue(image.State) == ec2.ImageStatePending {
+			image.State = aws.String(ec2.ImageStateAvailable)
+		}
+	}
+}
+
+// FailOn makes the next call to action return err. Queue several errors to
+// fail several calls in a row.
+func (f *EC2) FailOn(action string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[action] = append(f.errors[action], err)
+}
+
+// Called reports how many times action was invoked.
+func (f *EC2) Called(action string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.Calls {
+		if c == action {
+			n++
+		}
+	}
+	return n
+}
+
+// call records action and returns any error queued for it. The caller must hold mu.
+func (f *EC2) call(action string) error {
+	f.Calls = append(f.Calls, action)
+	if errs := f.errors[action]; len(errs) > 0 {
+		f.errors[action] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (f *EC2) id(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%08x", prefix, f.nextID)
+}
+
+func notFound(code, id string) error {
+	return awserr.New(code, fmt.Sprintf("The ID '%s' does not exist", id), nil)
+}
+
+func tags(specs []*ec2.TagSpecification, resourceType string) []*ec2.Tag {
+	for _, spec := range specs {
+		if aws.StringValue(spec.ResourceType) == resourceType {
+			return spec.Tags
+		}
+	}
+	return nil
+}
+
+// matches applies the tag:Key and state filters used by this tool.
+func matches(filters []*ec2.Filter, resourceTags []*ec2.Tag, state string) bool {
+	for _, filter := range filters {
+		name := aws.StringValue(filter.Name)
+		var value string
+		var ok bool
+		switch {
+		case strings.HasPrefix(name, "tag:"):
+			for _, tag := range resourceTags {
+				if aws.StringValue(tag.Key) == strings.TrimPrefix(name, "tag:") {
+					value, ok = aws.StringValue(tag.Value), true
+				}
+			}
+		case name == "instance-state-name" || name == "status" || name == "state":
+			value, ok = state, true
+		default:
+			continue
+		}
+		if !ok || !contains(aws.StringValueSlice(filter.Values), value) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func selected(ids []*string, id string) bool {
+	return len(ids) == 0 || contains(aws.StringValueSlice(ids), id)
+}
+
+func (f *EC2) CreateKeyPairWithContext(ctx aws.Context, input *ec2.CreateKeyPairInput, opts ...request.Option) (*ec2.CreateKeyPairOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateKeyPair"); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(input.KeyName)
+	if _, ok := f.KeyPairs[name]; ok {
+		return nil, awserr.New("InvalidKeyPair.Duplicate", fmt.Sprintf("The keypair '%s' already exists.", name), nil)
+	}
+	f.KeyPairs[name] = &ec2.KeyPairInfo{
+		KeyName:    aws.String(name),
+		KeyPairId:  aws.String(f.id("key")),
+		CreateTime: aws.Time(time.Now()),
+		Tags:       tags(input.TagSpecifications, ec2.ResourceTypeKeyPair),
+	}
+	return &ec2.CreateKeyPairOutput{
+		KeyName:     aws.String(name),
+		KeyPairId:   f.KeyPairs[name].KeyPairId,
+		KeyMaterial: aws.String("fake key material for " + name),
+	}, nil
+}
+
+func (f *EC2) ImportKeyPairWithContext(ctx aws.Context, input *ec2.ImportKeyPairInput, opts ...request.Option) (*ec2.ImportKeyPairOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ImportKeyPair"); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(input.KeyName)
+	if _, ok := f.KeyPairs[name]; ok {
+		return nil, awserr.New("InvalidKeyPair.Duplicate", fmt.Sprintf("The keypair '%s' already exists.", name), nil)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(input.PublicKeyMaterial)
+	if err != nil {
+		return nil, awserr.New("InvalidKey.Format", "Key is not in valid OpenSSH public key format", nil)
+	}
+	f.KeyPairs[name] = &ec2.KeyPairInfo{
+		KeyName:        aws.String(name),
+		KeyPairId:      aws.String(f.id("key")),
+		KeyFingerprint: aws.String(ssh.FingerprintSHA256(key)),
+		KeyType:        aws.String(strings.TrimPrefix(key.Type(), "ssh-")),
+		PublicKey:      aws.String(string(input.PublicKeyMaterial)),
+		CreateTime:     aws.Time(time.Now()),
+		Tags:           tags(input.TagSpecifications, ec2.ResourceTypeKeyPair),
+	}
+	return &ec2.ImportKeyPairOutput{
+		KeyName:        aws.String(name),
+		KeyPairId:      f.KeyPairs[name].KeyPairId,
+		KeyFingerprint: f.KeyPairs[name].KeyFingerprint,
+	}, nil
+}
+
+func (f *EC2) DeleteKeyPair(input *ec2.DeleteKeyPairInput) (*ec2.DeleteKeyPairOutput, error) {
+	return f.DeleteKeyPairWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *EC2) DeleteKeyPairWithContext(ctx aws.Context, input *ec2.DeleteKeyPairInput, opts ...request.Option) (*ec2.DeleteKeyPairOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteKeyPair"); err != nil {
+		return nil, err
+	}
+	delete(f.KeyPairs, aws.StringValue(input.KeyName))
+	return &ec2.DeleteKeyPairOutput{}, nil
+}
+
+func (f *EC2) DescribeKeyPairsWithContext(ctx aws.Context, input *ec2.DescribeKeyPairsInput, opts ...request.Option) (*ec2.DescribeKeyPairsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeKeyPairs"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeKeyPairsOutput{}
+	for name, k := range f.KeyPairs {
+		if selected(input.KeyNames, name) && matches(input.Filters, k.Tags, "") {
+			out.KeyPairs = append(out.KeyPairs, k)
+		}
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeSubnetsWithContext(ctx aws.Context, input *ec2.DescribeSubnetsInput, opts ...request.Option) (*ec2.DescribeSubnetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSubnets"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeSubnetsOutput{}
+	for _, id := range input.SubnetIds {
+		subnet, ok := f.Subnets[aws.StringValue(id)]
+		if !ok {
+			return nil, notFound("InvalidSubnetID.NotFound", aws.StringValue(id))
+		}
+		out.Subnets = append(out.Subnets, subnet)
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeVpcsWithContext(ctx aws.Context, input *ec2.DescribeVpcsInput, opts ...request.Option) (*ec2.DescribeVpcsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeVpcs"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeVpcsOutput{}
+	for _, id := range input.VpcIds {
+		vpc, ok := f.Vpcs[aws.StringValue(id)]
+		if !ok {
+			return nil, notFound("InvalidVpcID.NotFound", aws.StringValue(id))
+		}
+		out.Vpcs = append(out.Vpcs, vpc)
+	}
+	return out, nil
+}
+
+func (f *EC2) CreateSecurityGroupWithContext(ctx aws.Context, input *ec2.CreateSecurityGroupInput, opts ...request.Option) (*ec2.CreateSecurityGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateSecurityGroup"); err != nil {
+		return nil, err
+	}
+	id := f.id("sg")
+	f.SecurityGroups[id] = &ec2.SecurityGroup{
+		GroupId:     aws.String(id),
+		GroupName:   input.GroupName,
+		Description: input.Description,
+		VpcId:       input.VpcId,
+		Tags:        tags(input.TagSpecifications, ec2.ResourceTypeSecurityGroup),
+	}
+	return &ec2.CreateSecurityGroupOutput{GroupId: aws.String(id)}, nil
+}
+
+func (f *EC2) AuthorizeSecurityGroupIngressWithContext(ctx aws.Context, input *ec2.AuthorizeSecurityGroupIngressInput, opts ...request.Option) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AuthorizeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+	sg, ok := f.SecurityGroups[aws.StringValue(input.GroupId)]
+	if !ok {
+		return nil, notFound("InvalidGroup.NotFound", aws.StringValue(input.GroupId))
+	}
+	if input.CidrIp != nil {
+		sg.IpPermissions = append(sg.IpPermissions, &ec2.IpPermission{
+			IpProtocol: input.IpProtocol,
+			FromPort:   input.FromPort,
+			ToPort:     input.ToPort,
+			IpRanges:   []*ec2.IpRange{{CidrIp: input.CidrIp}},
+		})
+	}
+	sg.IpPermissions = append(sg.IpPermissions, input.IpPermissions...)
+	return &ec2.AuthorizeSecurityGroupIngressOutput{Return: aws.Bool(true)}, nil
+}
+
+func (f *EC2) DeleteSecurityGroup(input *ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error) {
+	return f.DeleteSecurityGroupWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *EC2) DeleteSecurityGroupWithContext(ctx aws.Context, input *ec2.DeleteSecurityGroupInput, opts ...request.Option) (*ec2.DeleteSecurityGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteSecurityGroup"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.GroupId)
+	if _, ok := f.SecurityGroups[id]; !ok {
+		return nil, notFound("InvalidGroup.NotFound", id)
+	}
+	for _, i := range f.Instances {
+		if aws.StringValue(i.State.Name) == ec2.InstanceStateNameTerminated {
+			continue
+		}
+		for _, group := range i.SecurityGroups {
+			if aws.StringValue(group.GroupId) == id {
+				return nil, awserr.New("DependencyViolation", "resource "+id+" has a dependent object", nil)
+			}
+		}
+	}
+	delete(f.SecurityGroups, id)
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func (f *EC2) DescribeSecurityGroupsWithContext(ctx aws.Context, input *ec2.DescribeSecurityGroupsInput, opts ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSecurityGroups"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeSecurityGroupsOutput{}
+	for id, sg := range f.SecurityGroups {
+		if selected(input.GroupIds, id) && matches(input.Filters, sg.Tags, "") {
+			out.SecurityGroups = append(out.SecurityGroups, sg)
+		}
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeSecurityGroupsPagesWithContext(ctx aws.Context, input *ec2.DescribeSecurityGroupsInput, fn func(*ec2.DescribeSecurityGroupsOutput, bool) bool, opts ...request.Option) error {
+	out, err := f.DescribeSecurityGroupsWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+func (f *EC2) RunInstancesWithContext(ctx aws.Context, input *ec2.RunInstancesInput, opts ...request.Option) (*ec2.Reservation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("RunInstances"); err != nil {
+		return nil, err
+	}
+	if len(input.NetworkInterfaces) == 0 {
+		return nil, awserr.New("InvalidParameterValue", "a network interface is required", nil)
+	}
+	nic := input.NetworkInterfaces[0]
+	subnet, ok := f.Subnets[aws.StringValue(nic.SubnetId)]
+	if !ok {
+		return nil, notFound("InvalidSubnetID.NotFound", aws.StringValue(nic.SubnetId))
+	}
+	if input.KeyName != nil {
+		if _, ok := f.KeyPairs[aws.StringValue(input.KeyName)]; !ok {
+			return nil, notFound("InvalidKeyPair.NotFound", aws.StringValue(input.KeyName))
+		}
+	}
+	var groups []*ec2.GroupIdentifier
+	for _, id := range nic.Groups {
+		if _, ok := f.SecurityGroups[aws.StringValue(id)]; !ok {
+			return nil, notFound("InvalidGroup.NotFound", aws.StringValue(id))
+		}
+		groups = append(groups, &ec2.GroupIdentifier{GroupId: id})
+	}
+	id := f.id("i")
+	instance := &ec2.Instance{
+		InstanceId:       aws.String(id),
+		ImageId:          input.ImageId,
+		InstanceType:     input.InstanceType,
+		KeyName:          input.KeyName,
+		LaunchTime:       aws.Time(time.Now()),
+		Placement:        &ec2.Placement{AvailabilityZone: subnet.AvailabilityZone},
+		PrivateIpAddress: aws.String(fmt.Sprintf("10.0.0.%d", f.nextID%250+4)),
+		SecurityGroups:   groups,
+		State:            &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNamePending)},
+		SubnetId:         subnet.SubnetId,
+		VpcId:            subnet.VpcId,
+		Tags:             tags(input.TagSpecifications, ec2.ResourceTypeInstance),
+		NetworkInterfaces: []*ec2.InstanceNetworkInterface{{
+			NetworkInterfaceId: aws.String(f.id("eni")),
+			SubnetId:           subnet.SubnetId,
+		}},
+	}
+	if options := input.InstanceMarketOptions; options != nil && aws.StringValue(options.MarketType) == ec2.MarketTypeSpot {
+		instance.InstanceLifecycle = aws.String(ec2.InstanceLifecycleTypeSpot)
+	}
+	if options := input.MetadataOptions; options != nil {
+		instance.MetadataOptions = &ec2.InstanceMetadataOptionsResponse{
+			HttpEndpoint: options.HttpEndpoint,
+			HttpTokens:   options.HttpTokens,
+		}
+	}
+	if input.IamInstanceProfile != nil {
+		instance.IamInstanceProfile = &ec2.IamInstanceProfile{Arn: input.IamInstanceProfile.Name}
+	}
+	if aws.BoolValue(nic.AssociatePublicIpAddress) {
+		if f.PublicIP != "" {
+			instance.PublicIpAddress = aws.String(f.PublicIP)
+		} else {
+			instance.PublicIpAddress = aws.String(fmt.Sprintf("203.0.113.%d", f.nextID%250+4))
+		}
+	}
+	f.Instances[id] = instance
+	// The root volume goes away with the instance
+	root := f.id("vol")
+	f.Volumes[root] = &ec2.Volume{
+		VolumeId:         aws.String(root),
+		AvailabilityZone: subnet.AvailabilityZone,
+		Size:             aws.Int64(8),
+		VolumeType:       aws.String(ec2.VolumeTypeGp2),
+		Encrypted:        aws.Bool(false),
+		CreateTime:       aws.Time(time.Now()),
+		State:            aws.String(ec2.VolumeStateInUse),
+		Tags:             tags(input.TagSpecifications, ec2.ResourceTypeVolume),
+		Attachments: []*ec2.VolumeAttachment{{
+			Device:              aws.String("/dev/xvda"),
+			InstanceId:          aws.String(id),
+			VolumeId:            aws.String(root),
+			State:               aws.String(ec2.VolumeAttachmentStateAttached),
+			DeleteOnTermination: aws.Bool(true),
+		}},
+	}
+	return &ec2.Reservation{Instances: []*ec2.Instance{instance}}, nil
+}
+
+func (f *EC2) GetConsoleOutputWithContext(ctx aws.Context, input *ec2.GetConsoleOutputInput, opts ...request.Option) (*ec2.GetConsoleOutputOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetConsoleOutput"); err != nil {
+		return nil, err
+	}
+	instance, ok := f.Instances[aws.StringValue(input.InstanceId)]
+	if !ok {
+		return nil, notFound("InvalidInstanceID.NotFound", aws.StringValue(input.InstanceId))
+	}
+	out := &ec2.GetConsoleOutputOutput{InstanceId: input.InstanceId, Timestamp: aws.Time(time.Now())}
+	if aws.StringValue(instance.State.Name) == ec2.InstanceStateNameRunning && f.ConsoleOutput != "" {
+		out.Output = aws.String(base64.StdEncoding.EncodeToString([]byte(f.ConsoleOutput)))
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeNetworkInterfacesWithContext(ctx aws.Context, input *ec2.DescribeNetworkInterfacesInput, opts ...request.Option) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeNetworkInterfaces"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeNetworkInterfacesOutput{}
+	for _, i := range f.Instances {
+		for _, nic := range i.NetworkInterfaces {
+			if !selected(input.NetworkInterfaceIds, aws.StringValue(nic.NetworkInterfaceId)) {
+				continue
+			}
+			iface := &ec2.NetworkInterface{
+				NetworkInterfaceId: nic.NetworkInterfaceId,
+				PrivateIpAddress:   i.PrivateIpAddress,
+				SubnetId:           nic.SubnetId,
+			}
+			if i.PublicIpAddress != nil {
+				iface.Association = &ec2.NetworkInterfaceAssociation{PublicIp: i.PublicIpAddress}
+			}
+			out.NetworkInterfaces = append(out.NetworkInterfaces, iface)
+		}
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	reservation := &ec2.Reservation{}
+	for id, i := range f.Instances {
+		if selected(input.InstanceIds, id) && matches(input.Filters, i.Tags, aws.StringValue(i.State.Name)) {
+			reservation.Instances = append(reservation.Instances, i)
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, nil
+}
+
+func (f *EC2) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	out, err := f.DescribeInstancesWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+// waitInstance moves pending instances along and checks they reach state.
+func (f *EC2) waitInstance(action string, ids []*string, state string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(action); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		i, ok := f.Instances[aws.StringValue(id)]
+		if !ok {
+			return notFound("InvalidInstanceID.NotFound", aws.StringValue(id))
+		}
+		if aws.StringValue(i.State.Name) == ec2.InstanceStateNamePending {
+			i.State.Name = aws.String(ec2.InstanceStateNameRunning)
+		}
+		if aws.StringValue(i.State.Name) != state {
+			return awserr.New(request.WaiterResourceNotReadyErrorCode, "failed waiting for successful resource state", nil)
+		}
+	}
+	return nil
+}
+
+func (f *EC2) WaitUntilInstanceRunningWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.WaiterOption) error {
+	return f.waitInstance("WaitUntilInstanceRunning", input.InstanceIds, ec2.InstanceStateNameRunning)
+}
+
+func (f *EC2) WaitUntilInstanceTerminated(input *ec2.DescribeInstancesInput) error {
+	return f.WaitUntilInstanceTerminatedWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *EC2) WaitUntilInstanceTerminatedWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.WaiterOption) error {
+	return f.waitInstance("WaitUntilInstanceTerminated", input.InstanceIds, ec2.InstanceStateNameTerminated)
+}
+
+func (f *EC2) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	return f.TerminateInstancesWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *EC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("TerminateInstances"); err != nil {
+		return nil, err
+	}
+	out := &ec2.TerminateInstancesOutput{}
+	for _, id := range input.InstanceIds {
+		i, ok := f.Instances[aws.StringValue(id)]
+		if !ok {
+			return nil, notFound("InvalidInstanceID.NotFound", aws.StringValue(id))
+		}
+		i.State.Name = aws.String(ec2.InstanceStateNameTerminated)
+		// Volumes attached after launch survive termination
+		for volumeID, v := range f.Volumes {
+			if len(v.Attachments) == 0 || aws.StringValue(v.Attachments[0].InstanceId) != aws.StringValue(id) {
+				continue
+			}
+			if aws.BoolValue(v.Attachments[0].DeleteOnTermination) {
+				delete(f.Volumes, volumeID)
+				continue
+			}
+			v.Attachments = nil
+			v.State = aws.String(ec2.VolumeStateAvailable)
+		}
+		out.TerminatingInstances = append(out.TerminatingInstances, &ec2.InstanceStateChange{
+			InstanceId:   id,
+			CurrentState: i.State,
+		})
+	}
+	return out, nil
+}
+
+func (f *EC2) CreateVolumeWithContext(ctx aws.Context, input *ec2.CreateVolumeInput, opts ...request.Option) (*ec2.Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateVolume"); err != nil {
+		return nil, err
+	}
+	id := f.id("vol")
+	v := &ec2.Volume{
+		VolumeId:         aws.String(id),
+		AvailabilityZone: input.AvailabilityZone,
+		Size:             input.Size,
+		VolumeType:       input.VolumeType,
+		Iops:             input.Iops,
+		Throughput:       input.Throughput,
+		Encrypted:        aws.Bool(aws.BoolValue(input.Encrypted)),
+		KmsKeyId:         input.KmsKeyId,
+		SnapshotId:       input.SnapshotId,
+		CreateTime:       aws.Time(time.Now()),
+		State:            aws.String(ec2.VolumeStateCreating),
+		Tags:             tags(input.TagSpecifications, ec2.ResourceTypeVolume),
+	}
+	f.Volumes[id] = v
+	return v, nil
+}
+
+func (f *EC2) WaitUntilVolumeAvailable(input *ec2.DescribeVolumesInput) error {
+	return f.WaitUntilVolumeAvailableWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *EC2) WaitUntilVolumeAvailableWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, opts ...request.WaiterOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("WaitUntilVolumeAvailable"); err != nil {
+		return err
+	}
+	for _, id := range input.VolumeIds {
+		v, ok := f.Volumes[aws.StringValue(id)]
+		if !ok {
+			return notFound("InvalidVolume.NotFound", aws.StringValue(id))
+		}
+		if aws.StringValue(v.State) == ec2.VolumeStateCreating {
+			v.State = aws.String(ec2.VolumeStateAvailable)
+		}
+		if aws.StringValue(v.State) != ec2.VolumeStateAvailable {
+			return awserr.New(request.WaiterResourceNotReadyErrorCode, "failed waiting for successful resource state", nil)
+		}
+	}
+	return nil
+}
+
+func (f *EC2) AttachVolumeWithContext(ctx aws.Context, input *ec2.AttachVolumeInput, opts ...request.Option) (*ec2.VolumeAttachment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AttachVolume"); err != nil {
+		return nil, err
+	}
+	v, ok := f.Volumes[aws.StringValue(input.VolumeId)]
+	if !ok {
+		return nil, notFound("InvalidVolume.NotFound", aws.StringValue(input.VolumeId))
+	}
+	i, ok := f.Instances[aws.StringValue(input.InstanceId)]
+	if !ok {
+		return nil, notFound("InvalidInstanceID.NotFound", aws.StringValue(input.InstanceId))
+	}
+	if aws.StringValue(v.State) != ec2.VolumeStateAvailable {
+		return nil, awserr.New("IncorrectState", "volume is not available", nil)
+	}
+	if aws.StringValue(v.AvailabilityZone) != aws.StringValue(i.Placement.AvailabilityZone) {
+		return nil, awserr.New("InvalidVolume.ZoneMismatch", "volume and instance are in different zones", nil)
+	}
+	attachment := &ec2.VolumeAttachment{
+		Device:     input.Device,
+		InstanceId: input.InstanceId,
+		VolumeId:   input.VolumeId,
+		State:      aws.String(ec2.VolumeAttachmentStateAttaching),
+	}
+	v.Attachments = []*ec2.VolumeAttachment{attachment}
+	v.State = aws.String(ec2.VolumeStateInUse)
+	return attachment, nil
+}
+
+func (f *EC2) DetachVolume(input *ec2.DetachVolumeInput) (*ec2.VolumeAttachment, error) {
+	return f.DetachVolumeWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *EC2) DetachVolumeWithContext(ctx aws.Context, input *ec2.DetachVolumeInput, opts ...request.Option) (*ec2.VolumeAttachment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DetachVolume"); err != nil {
+		return nil, err
+	}
+	v, ok := f.Volumes[aws.StringValue(input.VolumeId)]
+	if !ok {
+		return nil, notFound("InvalidVolume.NotFound", aws.StringValue(input.VolumeId))
+	}
+	if len(v.Attachments) == 0 {
+		return nil, awserr.New("IncorrectState", fmt.Sprintf("Volume '%s' is in the 'available' state.", *v.VolumeId), nil)
+	}
+	attachment := v.Attachments[0]
+	if aws.StringValue(attachment.Device) == "/dev/xvda" {
+		return nil, awserr.New("IncorrectState", fmt.Sprintf("Unable to detach root volume '%s' from instance '%s'", *v.VolumeId, *attachment.InstanceId), nil)
+	}
+	attachment.State = aws.String(ec2.VolumeAttachmentStateDetached)
+	v.Attachments = nil
+	v.State = aws.String(ec2.VolumeStateAvailable)
+	return attachment, nil
+}
+
+func (f *EC2) DeleteVolume(input *ec2.DeleteVolumeInput) (*ec2.DeleteVolumeOutput, error) {
+	return f.DeleteVolumeWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *EC2) DeleteVolumeWithContext(ctx aws.Context, input *ec2.DeleteVolumeInput, opts ...request.Option) (*ec2.DeleteVolumeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteVolume"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.VolumeId)
+	v, ok := f.Volumes[id]
+	if !ok {
+		return nil, notFound("InvalidVolume.NotFound", id)
+	}
+	if aws.StringValue(v.State) == ec2.VolumeStateInUse {
+		return nil, awserr.New("VolumeInUse", fmt.Sprintf("Volume %s is currently attached", id), nil)
+	}
+	delete(f.Volumes, id)
+	return &ec2.DeleteVolumeOutput{}, nil
+}
+
+func (f *EC2) DescribeVolumesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, opts ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeVolumes"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeVolumesOutput{}
+	for id, v := range f.Volumes {
+		if selected(input.VolumeIds, id) && matches(input.Filters, v.Tags, aws.StringValue(v.State)) {
+			// Attachments complete once they've been seen attaching
+			described := *v
+			described.Attachments = nil
+			for _, attachment := range v.Attachments {
+				copied := *attachment
+				described.Attachments = append(described.Attachments, &copied)
+				if aws.StringValue(attachment.State) == ec2.VolumeAttachmentStateAttaching {
+					attachment.State = aws.String(ec2.VolumeAttachmentStateAttached)
+				}
+			}
+			out.Volumes = append(out.Volumes, &described)
+		}
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeVolumesPagesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, fn func(*ec2.DescribeVolumesOutput, bool) bool, opts ...request.Option) error {
+	out, err := f.DescribeVolumesWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+func (f *EC2) CreateSnapshotWithContext(ctx aws.Context, input *ec2.CreateSnapshotInput, opts ...request.Option) (*ec2.Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateSnapshot"); err != nil {
+		return nil, err
+	}
+	v, ok := f.Volumes[aws.StringValue(input.VolumeId)]
+	if !ok {
+		return nil, notFound("InvalidVolume.NotFound", aws.StringValue(input.VolumeId))
+	}
+	id := f.id("snap")
+	s := &ec2.Snapshot{
+		SnapshotId:  aws.String(id),
+		VolumeId:    v.VolumeId,
+		VolumeSize:  v.Size,
+		Encrypted:   v.Encrypted,
+		KmsKeyId:    v.KmsKeyId,
+		Description: input.Description,
+		StartTime:   aws.Time(time.Now()),
+		State:       aws.String(ec2.SnapshotStatePending),
+		Tags:        tags(input.TagSpecifications, ec2.ResourceTypeSnapshot),
+	}
+	f.Snapshots[id] = s
+	return s, nil
+}
+
+func (f *EC2) WaitUntilSnapshotCompletedWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput, opts ...request.WaiterOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("WaitUntilSnapshotCompleted"); err != nil {
+		return err
+	}
+	for _, id := range input.SnapshotIds {
+		s, ok := f.Snapshots[aws.StringValue(id)]
+		if !ok {
+			return notFound("InvalidSnapshot.NotFound", aws.StringValue(id))
+		}
+		s.State = aws.String(ec2.SnapshotStateCompleted)
+	}
+	return nil
+}
+
+func (f *EC2) DeleteSnapshot(input *ec2.DeleteSnapshotInput) (*ec2.DeleteSnapshotOutput, error) {
+	return f.DeleteSnapshotWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *EC2) DeleteSnapshotWithContext(ctx aws.Context, input *ec2.DeleteSnapshotInput, opts ...request.Option) (*ec2.DeleteSnapshotOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteSnapshot"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.SnapshotId)
+	if _, ok := f.Snapshots[id]; !ok {
+		return nil, notFound("InvalidSnapshot.NotFound", id)
+	}
+	for _, image := range f.Images {
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.Ebs != nil && aws.StringValue(mapping.Ebs.SnapshotId) == id {
+				return nil, awserr.New("InvalidSnapshot.InUse", fmt.Sprintf("The snapshot %s is currently in use by %s", id, *image.ImageId), nil)
+			}
+		}
+	}
+	delete(f.Snapshots, id)
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func (f *EC2) DescribeSnapshotsWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput, opts ...request.Option) (*ec2.DescribeSnapshotsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSnapshots"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeSnapshotsOutput{}
+	for id, s := range f.Snapshots {
+		if selected(input.SnapshotIds, id) && matches(input.Filters, s.Tags, aws.StringValue(s.State)) {
+			out.Snapshots = append(out.Snapshots, s)
+		}
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeSnapshotsPagesWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput, fn func(*ec2.DescribeSnapshotsOutput, bool) bool, opts ...request.Option) error {
+	out, err := f.DescribeSnapshotsWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+func (f *EC2) RegisterImageWithContext(ctx aws.Context, input *ec2.RegisterImageInput, opts ...request.Option) (*ec2.RegisterImageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("RegisterImage"); err != nil {
+		return nil, err
+	}
+	for _, mapping := range input.BlockDeviceMappings {
+		if mapping.Ebs == nil || mapping.Ebs.SnapshotId == nil {
+			continue
+		}
+		s, ok := f.Snapshots[aws.StringValue(mapping.Ebs.SnapshotId)]
+		if !ok {
+			return nil, notFound("InvalidSnapshot.NotFound", aws.StringValue(mapping.Ebs.SnapshotId))
+		}
+		if aws.StringValue(s.State) != ec2.SnapshotStateCompleted {
+			return nil, awserr.New("IncorrectState", "snapshot is not completed", nil)
+		}
+		if size := mapping.Ebs.VolumeSize; size != nil && *size < aws.Int64Value(s.VolumeSize) {
+			return nil, awserr.New("InvalidBlockDeviceMapping", fmt.Sprintf("Volume of size %dGB is smaller than snapshot %s", *size, *s.SnapshotId), nil)
+		}
+	}
+	for _, image := range f.Images {
+		if aws.StringValue(image.Name) == aws.StringValue(input.Name) {
+			return nil, awserr.New("InvalidAMIName.Duplicate", fmt.Sprintf("AMI name %s is already in use", *input.Name), nil)
+		}
+	}
+	id := f.id("ami")
+	f.Images[id] = &ec2.Image{
+		ImageId:             aws.String(id),
+		Name:                input.Name,
+		Description:         input.Description,
+		Architecture:        input.Architecture,
+		RootDeviceName:      input.RootDeviceName,
+		VirtualizationType:  input.VirtualizationType,
+		BlockDeviceMappings: input.BlockDeviceMappings,
+		BootMode:            input.BootMode,
+		ImdsSupport:         input.ImdsSupport,
+		EnaSupport:          input.EnaSupport,
+		SriovNetSupport:     input.SriovNetSupport,
+		CreationDate:        aws.String(time.Now().UTC().Format(time.RFC3339)),
+		State:               aws.String(ec2.ImageStateAvailable),
+		OwnerId:             aws.String("123456789012"),
+		Tags:                tags(input.TagSpecifications, ec2.ResourceTypeImage),
+	}
+	return &ec2.RegisterImageOutput{ImageId: aws.String(id)}, nil
+}
+
+func (f *EC2) DescribeImagesWithContext(ctx aws.Context, input *ec2.DescribeImagesInput, opts ...request.Option) (*ec2.DescribeImagesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeImages"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeImagesOutput{}
+	for id, image := range f.Images {
+		if selected(input.ImageIds, id) && matches(input.Filters, image.Tags, aws.StringValue(image.State)) {
+			out.Images = append(out.Images, image)
+		}
+	}
+	for _, id := range aws.StringValueSlice(input.ImageIds) {
+		if _, ok := f.Images[id]; ok {
+			continue
+		}
+		image, ok := f.BaseImages[id]
+		if !ok {
+			image = &ec2.Image{
+				ImageId:      aws.String(id),
+				Architecture: aws.String(ec2.ArchitectureValuesX8664),
+				State:        aws.String(ec2.ImageStateAvailable),
+				OwnerId:      aws.String("679593333241"),
+				Public:       aws.Bool(true),
+			}
+		}
+		out.Images = append(out.Images, image)
+	}
+	return out, nil
+}
+
+func (f *EC2) CopyImageWithContext(ctx aws.Context, input *ec2.CopyImageInput, opts ...request.Option) (*ec2.CopyImageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CopyImage"); err != nil {
+		return nil, err
+	}
+	// Images from other regions can't be checked and are trusted
+	source := &ec2.Image{Architecture: aws.String(ec2.ArchitectureValuesX8664)}
+	if aws.StringValue(input.SourceRegion) == f.Region {
+		var ok bool
+		if source, ok = f.Images[aws.StringValue(input.SourceImageId)]; !ok {
+			return nil, notFound("InvalidAMIID.NotFound", aws.StringValue(input.SourceImageId))
+		}
+	}
+	if input.KmsKeyId != nil && !aws.BoolValue(input.Encrypted) {
+		return nil, awserr.New("InvalidParameterCombination", "KmsKeyId requires Encrypted", nil)
+	}
+	snapshotID := f.id("snap")
+	f.Snapshots[snapshotID] = &ec2.Snapshot{
+		SnapshotId:  aws.String(snapshotID),
+		Encrypted:   input.Encrypted,
+		KmsKeyId:    input.KmsKeyId,
+		Description: input.Description,
+		StartTime:   aws.Time(time.Now()),
+		State:       aws.String(ec2.SnapshotStateCompleted),
+		Tags:        tags(input.TagSpecifications, ec2.ResourceTypeSnapshot),
+	}
+	id := f.id("ami")
+	f.Images[id] = &ec2.Image{
+		ImageId:            aws.String(id),
+		Name:               input.Name,
+		Description:        input.Description,
+		Architecture:       source.Architecture,
+		RootDeviceName:     source.RootDeviceName,
+		VirtualizationType: source.VirtualizationType,
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+			DeviceName: source.RootDeviceName,
+			Ebs:        &ec2.EbsBlockDevice{SnapshotId: aws.String(snapshotID), Encrypted: input.Encrypted},
+		}},
+		BootMode:        source.BootMode,
+		ImdsSupport:     source.ImdsSupport,
+		EnaSupport:      source.EnaSupport,
+		SriovNetSupport: source.SriovNetSupport,
+		CreationDate:    aws.String(time.Now().UTC().Format(time.RFC3339)),
+		State:           aws.String(ec2.ImageStatePending),
+		OwnerId:         aws.String("123456789012"),
+		Tags:            tags(input.TagSpecifications, ec2.ResourceTypeImage),
+	}
+	return &ec2.CopyImageOutput{ImageId: aws.String(id)}, nil
+}
+
+func (f *EC2) ModifyImageAttributeWithContext(ctx aws.Context, input *ec2.ModifyImageAttributeInput, opts ...request.Option) (*ec2.ModifyImageAttributeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ModifyImageAttribute"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.ImageId)
+	if _, ok := f.Images[id]; !ok {
+		return nil, notFound("InvalidAMIID.NotFound", id)
+	}
+	if changes := input.LaunchPermission; changes != nil {
+		permissions := append(f.LaunchPermissions[id], changes.Add...)
+		kept := permissions[:0]
+		for _, p := range permissions {
+			removed := false
+			for _, r := range changes.Remove {
+				removed = removed || p.String() == r.String()
+			}
+			if !removed {
+				kept = append(kept, p)
+			}
+		}
+		f.LaunchPermissions[id] = kept
+	}
+	return &ec2.ModifyImageAttributeOutput{}, nil
+}
+
+func (f *EC2) ModifySnapshotAttributeWithContext(ctx aws.Context, input *ec2.ModifySnapshotAttributeInput, opts ...request.Option) (*ec2.ModifySnapshotAttributeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ModifySnapshotAttribute"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.SnapshotId)
+	if _, ok := f.Snapshots[id]; !ok {
+		return nil, notFound("InvalidSnapshot.NotFound", id)
+	}
+	if changes := input.CreateVolumePermission; changes != nil {
+		permissions := append(f.VolumePermissions[id], changes.Add...)
+		kept := permissions[:0]
+		for _, p := range permissions {
+			removed := false
+			for _, r := range changes.Remove {
+				removed = removed || aws.StringValue(p.UserId) == aws.StringValue(r.UserId)
+			}
+			if !removed {
+				kept = append(kept, p)
+			}
+		}
+		f.VolumePermissions[id] = kept
+	}
+	return &ec2.ModifySnapshotAttributeOutput{}, nil
+}
+
+func (f *EC2) WaitUntilImageAvailableWithContext(ctx aws.Context, input *ec2.DescribeImagesInput, opts ...request.WaiterOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("WaitUntilImageAvailable"); err != nil {
+		return err
+	}
+	for _, id := range input.ImageIds {
+		image, ok := f.Images[aws.StringValue(id)]
+		if !ok {
+			return notFound("InvalidAMIID.NotFound", aws.StringValue(id))
+		}
+		image.State = aws.String(ec2.ImageStateAvailable)
+	}
+	return nil
+}
+
+func (f *EC2) DeregisterImageWithContext(ctx aws.Context, input *ec2.DeregisterImageInput, opts ...request.Option) (*ec2.DeregisterImageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeregisterImage"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.ImageId)
+	if _, ok := f.Images[id]; !ok {
+		return nil, notFound("InvalidAMIID.NotFound", id)
+	}
+	// The snapshots are left behind, as they are by EC2
+	delete(f.Images, id)
+	delete(f.LaunchPermissions, id)
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+// AddLaunchTemplate registers a launch template with a version for each image.
+func (f *EC2) AddLaunchTemplate(id string, imageIDs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var versions []*ec2.LaunchTemplateVersion
+	for i, imageID := range imageIDs {
+		versions = append(versions, &ec2.LaunchTemplateVersion{
+			LaunchTemplateId:   aws.String(id),
+			LaunchTemplateName: aws.String(id),
+			VersionNumber:      aws.Int64(int64(i + 1)),
+			DefaultVersion:     aws.Bool(i == 0),
+			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{ImageId: aws.String(imageID)},
+		})
+	}
+	f.LaunchTemplates[id] = versions
+}
+
+func (f *EC2) DescribeLaunchTemplatesWithContext(ctx aws.Context, input *ec2.DescribeLaunchTemplatesInput, opts ...request.Option) (*ec2.DescribeLaunchTemplatesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeLaunchTemplates"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeLaunchTemplatesOutput{}
+	for id, versions := range f.LaunchTemplates {
+		if selected(input.LaunchTemplateIds, id) {
+			out.LaunchTemplates = append(out.LaunchTemplates, &ec2.LaunchTemplate{
+				LaunchTemplateId:     aws.String(id),
+				LaunchTemplateName:   aws.String(id),
+				DefaultVersionNumber: aws.Int64(1),
+				LatestVersionNumber:  aws.Int64(int64(len(versions))),
+			})
+		}
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeLaunchTemplatesPagesWithContext(ctx aws.Context, input *ec2.DescribeLaunchTemplatesInput, fn func(*ec2.DescribeLaunchTemplatesOutput, bool) bool, opts ...request.Option) error {
+	out, err := f.DescribeLaunchTemplatesWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+func (f *EC2) DescribeLaunchTemplateVersionsWithContext(ctx aws.Context, input *ec2.DescribeLaunchTemplateVersionsInput, opts ...request.Option) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeLaunchTemplateVersions"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.LaunchTemplateId)
+	versions, ok := f.LaunchTemplates[id]
+	if !ok {
+		return nil, notFound("InvalidLaunchTemplateId.NotFound", id)
+	}
+	return &ec2.DescribeLaunchTemplateVersionsOutput{LaunchTemplateVersions: versions}, nil
+}
+
+func (f *EC2) DescribeLaunchTemplateVersionsPagesWithContext(ctx aws.Context, input *ec2.DescribeLaunchTemplateVersionsInput, fn func(*ec2.DescribeLaunchTemplateVersionsOutput, bool) bool, opts ...request.Option) error {
+	out, err := f.DescribeLaunchTemplateVersionsWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+// AddBaseImage registers a public image with the given architecture.
+func (f *EC2) AddBaseImage(id, arch string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.BaseImages[id] = &ec2.Image{
+		ImageId:      aws.String(id),
+		Architecture: aws.String(arch),
+		State:        aws.String(ec2.ImageStateAvailable),
+		OwnerId:      aws.String("679593333241"),
+		Public:       aws.Bool(true),
+	}
+}
+
+// graviton matches arm64 instance families such as a1, m6g, c6gn and t4g.
+var graviton = regexp.MustCompile(`^(a1|[a-z]+\d+g[a-z]*)\.`)
+
+func (f *EC2) DescribeInstanceTypesWithContext(ctx aws.Context, input *ec2.DescribeInstanceTypesInput, opts ...request.Option) (*ec2.DescribeInstanceTypesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeInstanceTypes"); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeInstanceTypesOutput{}
+	for _, instanceType := range aws.StringValueSlice(input.InstanceTypes) {
+		if !strings.Contains(instanceType, ".") {
+			return nil, awserr.New("InvalidInstanceType", fmt.Sprintf("The following supplied instance types do not exist: [%s]", instanceType), nil)
+		}
+		arch := ec2.ArchitectureTypeX8664
+		if graviton.MatchString(instanceType) {
+			arch = ec2.ArchitectureTypeArm64
+		}
+		out.InstanceTypes = append(out.InstanceTypes, &ec2.InstanceTypeInfo{
+			InstanceType:  aws.String(instanceType),
+			ProcessorInfo: &ec2.ProcessorInfo{SupportedArchitectures: aws.StringSlice([]string{arch})},
+		})
+	}
+	return out, nil
+}
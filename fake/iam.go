@@ -0,0 +1,135 @@
+package fake
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+// IAM is an in-memory stand-in for the IAM API covering roles and instance
+// profiles. Calling a method it doesn't implement panics.
+type IAM struct {
+	iamiface.IAMAPI
+
+	mu               sync.Mutex
+	InstanceProfiles map[string]*iam.InstanceProfile
+	Roles            map[string]*iam.Role
+	// RolePolicies maps role name to policy name to policy document
+	RolePolicies map[string]map[string]string
+	Calls        []string
+	errors       map[string][]error
+}
+
+// NewIAM returns an empty fake.
+func NewIAM() *IAM {
+	return &IAM{
+		InstanceProfiles: make(map[string]*iam.InstanceProfile),
+		Roles:            make(map[string]*iam.Role),
+		RolePolicies:     make(map[string]map[string]string),
+		errors:           make(map[string][]error),
+	}
+}
+
+// FailOn makes the next call to action return err.
+func (f *IAM) FailOn(action string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[action] = append(f.errors[action], err)
+}
+
+func (f *IAM) call(action string) error {
+	f.Calls = append(f.Calls, action)
+	if errs := f.errors[action]; len(errs) > 0 {
+		f.errors[action] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func exists(kind, name string) error {
+	return awserr.New(iam.ErrCodeEntityAlreadyExistsException, fmt.Sprintf("%s with name %s already exists.", kind, name), nil)
+}
+
+func noSuchEntity(kind, name string) error {
+	return awserr.New(iam.ErrCodeNoSuchEntityException, fmt.Sprintf("The %s with name %s cannot be found.", kind, name), nil)
+}
+
+func (f *IAM) CreateInstanceProfileWithContext(ctx aws.Context, input *iam.CreateInstanceProfileInput, opts ...request.Option) (*iam.CreateInstanceProfileOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateInstanceProfile"); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(input.InstanceProfileName)
+	if _, ok := f.InstanceProfiles[name]; ok {
+		return nil, exists("Instance Profile", name)
+	}
+	profile := &iam.InstanceProfile{
+		InstanceProfileName: aws.String(name),
+		Arn:                 aws.String("arn:aws:iam::123456789012:instance-profile/" + name),
+	}
+	f.InstanceProfiles[name] = profile
+	return &iam.CreateInstanceProfileOutput{InstanceProfile: profile}, nil
+}
+
+func (f *IAM) CreateRoleWithContext(ctx aws.Context, input *iam.CreateRoleInput, opts ...request.Option) (*iam.CreateRoleOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateRole"); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(input.RoleName)
+	if _, ok := f.Roles[name]; ok {
+		return nil, exists("Role", name)
+	}
+	role := &iam.Role{
+		RoleName:                 aws.String(name),
+		Arn:                      aws.String("arn:aws:iam::123456789012:role/" + name),
+		AssumeRolePolicyDocument: input.AssumeRolePolicyDocument,
+	}
+	f.Roles[name] = role
+	return &iam.CreateRoleOutput{Role: role}, nil
+}
+
+func (f *IAM) AddRoleToInstanceProfileWithContext(ctx aws.Context, input *iam.AddRoleToInstanceProfileInput, opts ...request.Option) (*iam.AddRoleToInstanceProfileOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AddRoleToInstanceProfile"); err != nil {
+		return nil, err
+	}
+	profile, ok := f.InstanceProfiles[aws.StringValue(input.InstanceProfileName)]
+	if !ok {
+		return nil, noSuchEntity("instance profile", aws.StringValue(input.InstanceProfileName))
+	}
+	role, ok := f.Roles[aws.StringValue(input.RoleName)]
+	if !ok {
+		return nil, noSuchEntity("role", aws.StringValue(input.RoleName))
+	}
+	if len(profile.Roles) > 0 {
+		return nil, awserr.New(iam.ErrCodeLimitExceededException, "Cannot exceed quota for InstanceSessionsPerInstanceProfile: 1", nil)
+	}
+	profile.Roles = append(profile.Roles, role)
+	return &iam.AddRoleToInstanceProfileOutput{}, nil
+}
+
+func (f *IAM) PutRolePolicyWithContext(ctx aws.Context, input *iam.PutRolePolicyInput, opts ...request.Option) (*iam.PutRolePolicyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("PutRolePolicy"); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(input.RoleName)
+	if _, ok := f.Roles[name]; !ok {
+		return nil, noSuchEntity("role", name)
+	}
+	if f.RolePolicies[name] == nil {
+		f.RolePolicies[name] = make(map[string]string)
+	}
+	f.RolePolicies[name][aws.StringValue(input.PolicyName)] = aws.StringValue(input.PolicyDocument)
+	return &iam.PutRolePolicyOutput{}, nil
+}
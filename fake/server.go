@@ -0,0 +1,270 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/private/protocol/xml/xmlutil"
+)
+
+// iamVersion is the API version sent with every IAM request. Anything else is EC2.
+const iamVersion = "2010-05-08"
+
+// ec2Actions and iamActions are the query actions served by Server.
+var ec2Actions = map[string]bool{
+	"CreateKeyPair":                  true,
+	"ImportKeyPair":                  true,
+	"DeleteKeyPair":                  true,
+	"DescribeKeyPairs":               true,
+	"DescribeSubnets":                true,
+	"DescribeVpcs":                   true,
+	"CreateSecurityGroup":            true,
+	"AuthorizeSecurityGroupIngress":  true,
+	"DeleteSecurityGroup":            true,
+	"DescribeSecurityGroups":         true,
+	"RunInstances":                   true,
+	"GetConsoleOutput":               true,
+	"DescribeInstances":              true,
+	"DescribeInstanceTypes":          true,
+	"TerminateInstances":             true,
+	"DescribeNetworkInterfaces":      true,
+	"CreateVolume":                   true,
+	"AttachVolume":                   true,
+	"DetachVolume":                   true,
+	"DeleteVolume":                   true,
+	"DescribeVolumes":                true,
+	"CreateSnapshot":                 true,
+	"DeleteSnapshot":                 true,
+	"DescribeSnapshots":              true,
+	"RegisterImage":                  true,
+	"DescribeImages":                 true,
+	"CopyImage":                      true,
+	"ModifyImageAttribute":           true,
+	"ModifySnapshotAttribute":        true,
+	"DeregisterImage":                true,
+	"DescribeLaunchTemplates":        true,
+	"DescribeLaunchTemplateVersions": true,
+}
+
+var iamActions = map[string]bool{
+	"CreateInstanceProfile":    true,
+	"CreateRole":               true,
+	"AddRoleToInstanceProfile": true,
+	"PutRolePolicy":            true,
+}
+
+// Server speaks the EC2 and IAM query protocols on top of the in-memory
+// fakes so the real binary can be pointed at it with --ec2 and --iam.
+type Server struct {
+	EC2 *EC2
+	IAM *IAM
+}
+
+// NewServer returns a server backed by the given fakes.
+func NewServer(ec2 *EC2, iam *IAM) *Server {
+	return &Server{ec2, iam}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.Form.Get("Action")
+	isEC2 := r.Form.Get("Version") != iamVersion
+	requestID := fmt.Sprintf("%x", time.Now().UnixNano())
+	log.Printf("%s %s", r.Form.Get("Version"), action)
+
+	var target reflect.Value
+	switch {
+	case isEC2 && ec2Actions[action]:
+		// Anything in flight completes between requests
+		s.EC2.Settle()
+		target = reflect.ValueOf(s.EC2)
+	case !isEC2 && iamActions[action]:
+		target = reflect.ValueOf(s.IAM)
+	default:
+		writeError(w, isEC2, requestID, awserr.New("InvalidAction", fmt.Sprintf("The action %s is not valid for this web service.", action), nil))
+		return
+	}
+	method := target.MethodByName(action + "WithContext")
+	input := reflect.New(method.Type().In(1).Elem())
+	if err := decode(r.Form, input, "", "", isEC2); err != nil {
+		writeError(w, isEC2, requestID, awserr.New("InvalidParameterValue", err.Error(), nil))
+		return
+	}
+	results := method.Call([]reflect.Value{reflect.ValueOf(r.Context()), input})
+	if err, _ := results[1].Interface().(error); err != nil {
+		writeError(w, isEC2, requestID, err)
+		return
+	}
+
+	var body bytes.Buffer
+	e := xml.NewEncoder(&body)
+	if err := xmlutil.BuildXML(results[0].Interface(), e); err != nil {
+		writeError(w, isEC2, requestID, err)
+		return
+	}
+	e.Flush()
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	w.Header().Set("X-Amzn-Requestid", requestID)
+	if isEC2 {
+		fmt.Fprintf(w, "<%sResponse><requestId>%s</requestId>%s</%sResponse>", action, requestID, body.String(), action)
+	} else {
+		fmt.Fprintf(w, "<%sResponse><%sResult>%s</%sResult><ResponseMetadata><RequestId>%s</RequestId></ResponseMetadata></%sResponse>",
+			action, action, body.String(), action, requestID, action)
+	}
+}
+
+type ec2Error struct {
+	XMLName   xml.Name `xml:"Response"`
+	Code      string   `xml:"Errors>Error>Code"`
+	Message   string   `xml:"Errors>Error>Message"`
+	RequestID string   `xml:"RequestID"`
+}
+
+type iamError struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Code      string   `xml:"Error>Code"`
+	Message   string   `xml:"Error>Message"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func writeError(w http.ResponseWriter, isEC2 bool, requestID string, err error) {
+	code, message := "InternalFailure", err.Error()
+	if awsErr, ok := err.(awserr.Error); ok {
+		code, message = awsErr.Code(), awsErr.Message()
+	}
+	var v interface{} = &iamError{Code: code, Message: message, RequestID: requestID}
+	if isEC2 {
+		v = &ec2Error{Code: code, Message: message, RequestID: requestID}
+	}
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	w.WriteHeader(http.StatusBadRequest)
+	xml.NewEncoder(w).Encode(v)
+}
+
+// decode is the reverse of the SDK's query serializer. It fills value, a
+// pointer, from the form parameters under prefix.
+func decode(form url.Values, value reflect.Value, prefix string, tag reflect.StructTag, isEC2 bool) error {
+	if value.Kind() == reflect.Ptr {
+		if prefix != "" && !present(form, prefix) {
+			return nil
+		}
+		if value.IsNil() {
+			value.Set(reflect.New(value.Type().Elem()))
+		}
+		return decode(form, value.Elem(), prefix, tag, isEC2)
+	}
+	switch value.Kind() {
+	case reflect.Struct:
+		if _, ok := value.Interface().(time.Time); ok {
+			t, err := time.Parse(time.RFC3339, form.Get(prefix))
+			if err != nil {
+				return err
+			}
+			value.Set(reflect.ValueOf(t))
+			return nil
+		}
+		t := value.Type()
+		for i := 0; i < value.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" || field.Tag.Get("ignore") != "" {
+				continue
+			}
+			name := fieldName(field, isEC2)
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			if err := decode(form, value.Field(i), name, field.Tag, isEC2); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := base64.StdEncoding.DecodeString(form.Get(prefix))
+			if err != nil {
+				return err
+			}
+			value.SetBytes(b)
+			return nil
+		}
+		if !isEC2 && tag.Get("flattened") == "" {
+			if listName := tag.Get("locationNameList"); listName != "" {
+				prefix += "." + listName
+			} else {
+				prefix += ".member"
+			}
+		}
+		for i := 1; present(form, fmt.Sprintf("%s.%d", prefix, i)); i++ {
+			elem := reflect.New(value.Type().Elem()).Elem()
+			if err := decode(form, elem, fmt.Sprintf("%s.%d", prefix, i), "", isEC2); err != nil {
+				return err
+			}
+			value.Set(reflect.Append(value, elem))
+		}
+	case reflect.String:
+		value.SetString(form.Get(prefix))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(form.Get(prefix))
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int64:
+		n, err := strconv.ParseInt(form.Get(prefix), 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(form.Get(prefix), 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(n)
+	}
+	return nil
+}
+
+// fieldName mirrors the parameter naming used by the SDK's query serializer.
+func fieldName(field reflect.StructField, isEC2 bool) string {
+	var name string
+	if isEC2 {
+		name = field.Tag.Get("queryName")
+	}
+	if name == "" {
+		if field.Tag.Get("flattened") != "" && field.Tag.Get("locationNameList") != "" {
+			name = field.Tag.Get("locationNameList")
+		} else {
+			name = field.Tag.Get("locationName")
+		}
+		if name != "" && isEC2 {
+			name = strings.ToUpper(name[0:1]) + name[1:]
+		}
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name
+}
+
+// present reports whether any parameter is named prefix or nested under it.
+func present(form url.Values, prefix string) bool {
+	for key := range form {
+		if key == prefix || strings.HasPrefix(key, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package fake_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/ami-builder/ami"
+	"github.com/amdonov/ami-builder/ansible"
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/amdonov/ami-builder/instance"
+	myssh "github.com/amdonov/ami-builder/ssh"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+type provisioner struct{}
+
+func (provisioner) Provision(ctx context.Context, host *myssh.Host) error {
+	return nil
+}
+
+type amiProvisioner struct{}
+
+func (amiProvisioner) Provision(ctx context.Context, host *myssh.Host, volumeID, bootMode string) error {
+	return nil
+}
+
+// clients returns real SDK clients talking to a fake server.
+func clients(t *testing.T) (*fake.Server, *ec2.EC2, *iam.IAM) {
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	server := fake.NewServer(f, fake.NewIAM())
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		Endpoint:    aws.String(ts.URL),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, ec2.New(sess), iam.New(sess)
+}
+
+func config(t *testing.T) *instance.Config {
+	return &instance.Config{
+		Subnets:  []string{"subnet-1"},
+		Name:     "test image",
+		ImageID:  "ami-base",
+		Sizes:    []string{"t2.micro"},
+		SSHCIDRs: []string{"192.0.2.0/24"},
+		IAMRole:  "ansible",
+		WorkDir:  t.TempDir(),
+	}
+}
+
+func TestCreateAMIOverHTTP(t *testing.T) {
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+
+	server, ec2Service, _ := clients(t)
+	if err := ami.CreateAMI(context.Background(), ec2Service, config(t), amiProvisioner{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.EC2.Images) != 1 {
+		t.Errorf("expected one image, got %v", server.EC2.Images)
+	}
+	if len(server.EC2.KeyPairs) != 0 || len(server.EC2.SecurityGroups) != 0 || len(server.EC2.Volumes) != 0 {
+		t.Error("temporary resources left behind")
+	}
+	for _, i := range server.EC2.Instances {
+		if len(i.Tags) != 3 {
+			t.Errorf("instance tags not received: %v", i.Tags)
+		}
+	}
+}
+
+func TestCopyAndShareOverHTTP(t *testing.T) {
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+
+	server, ec2Service, _ := clients(t)
+	c := config(t)
+	// The endpoint serves every region, so copies land in the same fake
+	c.Region = "us-east-1"
+	c.Regional = func(string) ec2iface.EC2API { return ec2Service }
+	c.CopyTo = []instance.Copy{{Region: "us-west-2", KMSKeyID: "alias/dr"}}
+	c.Sharing = instance.Sharing{
+		Accounts: []string{"111122223333"},
+		OrgARNs:  []string{"arn:aws:organizations::123456789012:organization/o-a1b2c3d4e5"},
+	}
+	if err := ami.CreateAMI(context.Background(), ec2Service, c, amiProvisioner{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.EC2.Images) != 2 {
+		t.Fatalf("expected the image and its copy, got %v", server.EC2.Images)
+	}
+	for id, image := range server.EC2.Images {
+		if aws.StringValue(image.State) != ec2.ImageStateAvailable || len(image.Tags) != 3 {
+			t.Errorf("%s is %s with tags %v", id, aws.StringValue(image.State), image.Tags)
+		}
+		if permissions := server.EC2.LaunchPermissions[id]; len(permissions) != 2 {
+			t.Errorf("%s launch permissions %v", id, permissions)
+		}
+		snapshotID := aws.StringValue(image.BlockDeviceMappings[0].Ebs.SnapshotId)
+		if permissions := server.EC2.VolumePermissions[snapshotID]; len(permissions) != 1 || aws.StringValue(permissions[0].UserId) != "111122223333" {
+			t.Errorf("%s volume permissions %v", snapshotID, permissions)
+		}
+	}
+}
+
+func TestCreateProvisionServerOverHTTP(t *testing.T) {
+	server, ec2Service, iamService := clients(t)
+	if err := ansible.CreateProvisionServer(context.Background(), ec2Service, iamService, config(t), provisioner{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.IAM.InstanceProfiles["ansible"]; !ok {
+		t.Error("instance profile not created")
+	}
+	for _, i := range server.EC2.Instances {
+		if i.IamInstanceProfile == nil {
+			t.Error("instance launched without a profile")
+		}
+	}
+}
+
+func TestErrorsOverHTTP(t *testing.T) {
+	_, ec2Service, _ := clients(t)
+	_, err := ec2Service.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{aws.String("subnet-missing")},
+	})
+	if err == nil || !strings.Contains(err.Error(), "InvalidSubnetID.NotFound") {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
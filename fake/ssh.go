@@ -0,0 +1,366 @@
+package fake
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH is an in-process SSH server standing in for a bootstrap machine. It
+// accepts a single key, receives files with scp, answers sha256sum for them
+// and records every other command, replying as scripted with Respond.
+type SSH struct {
+	// Addr is the host:port the server listens on
+	Addr string
+	// Fingerprint is the SHA256 fingerprint of the server's host key
+	Fingerprint string
+
+	mu          sync.Mutex
+	failUploads int
+	files       map[string][]byte
+	dirs        map[string]bool
+	commands    []string
+	responses   []Response
+	listener    net.Listener
+	config      *ssh.ServerConfig
+}
+
+// Response is the scripted result of commands containing Match.
+type Response struct {
+	Match      string
+	ExitStatus int
+	Stdout     string
+	Stderr     string
+}
+
+// NewSSH starts a server on a local port that accepts authorizedKey, in
+// authorized_keys format.
+func NewSSH(authorizedKey []byte) (*SSH, error) {
+	authorized, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKey)
+	if err != nil {
+		return nil, err
+	}
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, err
+	}
+	s := &SSH{
+		Fingerprint: ssh.FingerprintSHA256(hostKey.PublicKey()),
+		files:       make(map[string][]byte),
+		dirs:        make(map[string]bool),
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if ssh.FingerprintSHA256(key) != ssh.FingerprintSHA256(authorized) {
+				return nil, fmt.Errorf("unknown key for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	s.config.AddHostKey(hostKey)
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	s.Addr = s.listener.Addr().String()
+	go s.serve()
+	return s, nil
+}
+
+// Close stops accepting connections.
+func (s *SSH) Close() error {
+	return s.listener.Close()
+}
+
+// Respond scripts the result of commands containing match. The first
+// matching response wins and unmatched commands succeed silently.
+func (s *SSH) Respond(match string, exitStatus int, stdout, stderr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, Response{match, exitStatus, stdout, stderr})
+}
+
+// FailUploads rejects the next n upload attempts.
+func (s *SSH) FailUploads(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failUploads = n
+}
+
+// Files returns the uploaded files by path. Paths in home directories are
+// under /home/<user>.
+func (s *SSH) Files() map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make(map[string][]byte, len(s.files))
+	for name, data := range s.files {
+		files[name] = data
+	}
+	return files
+}
+
+// Commands lists the commands run, other than those serving uploads, in order.
+func (s *SSH) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *SSH) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *SSH) handle(conn net.Conn) {
+	server, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer server.Close()
+	// Refuse global requests, which still answers keepalives
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(server.User(), channel, requests)
+	}
+}
+
+func (s *SSH) session(user string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			// Environment, signals and the like are accepted and ignored
+			req.Reply(req.Type != "shell" && req.Type != "subsystem", nil)
+			continue
+		}
+		var msg struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		status := s.exec(user, msg.Command, channel)
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		return
+	}
+}
+
+// exec runs command, returning its exit status.
+func (s *SSH) exec(user, command string, channel ssh.Channel) int {
+	words, err := split(command)
+	if err != nil {
+		fmt.Fprintln(channel.Stderr(), err)
+		return 2
+	}
+	home := "/home/" + user
+	switch words[0] {
+	case "scp", "mkdir":
+		return s.scp(home, words, channel)
+	case "sha256sum":
+		return s.sha256sum(home, words[1:], channel)
+	}
+	s.mu.Lock()
+	s.commands = append(s.commands, command)
+	response := Response{}
+	for _, r := range s.responses {
+		if strings.Contains(command, r.Match) {
+			response = r
+			break
+		}
+	}
+	s.mu.Unlock()
+	io.WriteString(channel, response.Stdout)
+	io.WriteString(channel.Stderr(), response.Stderr)
+	return response.ExitStatus
+}
+
+// scp serves "scp [-r] -t target", optionally preceded by "mkdir -p target &&".
+func (s *SSH) scp(home string, words []string, channel ssh.Channel) int {
+	if words[0] == "mkdir" {
+		if len(words) < 4 || words[1] != "-p" || words[3] != "&&" {
+			fmt.Fprintf(channel.Stderr(), "unsupported command %q\n", strings.Join(words, " "))
+			return 2
+		}
+		s.mu.Lock()
+		s.dirs[expand(home, words[2])] = true
+		s.mu.Unlock()
+		words = words[4:]
+	}
+	if len(words) < 3 || words[0] != "scp" || words[len(words)-2] != "-t" {
+		fmt.Fprintf(channel.Stderr(), "unsupported command %q\n", strings.Join(words, " "))
+		return 2
+	}
+	s.mu.Lock()
+	reject := s.failUploads > 0
+	if reject {
+		s.failUploads--
+	}
+	s.mu.Unlock()
+	if reject {
+		channel.Write([]byte("\x02scp: No space left on device\n"))
+		return 1
+	}
+	if err := s.sink(expand(home, words[len(words)-1]), channel); err != nil {
+		fmt.Fprintf(channel, "\x02scp: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// sink receives files from an scp source, storing them under target.
+func (s *SSH) sink(target string, channel ssh.Channel) error {
+	in := bufio.NewReader(channel)
+	ack := func() { channel.Write([]byte{0}) }
+	ack()
+	dir := ""
+	s.mu.Lock()
+	if s.dirs[target] {
+		dir = target
+	}
+	s.mu.Unlock()
+	for {
+		line, err := in.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var mode, size int64
+		var name string
+		switch line[0] {
+		case 'C', 'D':
+			if _, err = fmt.Sscanf(line[1:], "%o %d %s", &mode, &size, &name); err != nil {
+				return fmt.Errorf("bad message %q", line)
+			}
+		case 'E':
+			if dir == target || dir == "" {
+				return errors.New("unexpected E")
+			}
+			dir = path.Dir(dir)
+			ack()
+			continue
+		case 'T':
+			ack()
+			continue
+		default:
+			return fmt.Errorf("bad message %q", line)
+		}
+		name = path.Join(dir, name)
+		if dir == "" {
+			name = target
+		}
+		if line[0] == 'D' {
+			s.mu.Lock()
+			s.dirs[name] = true
+			s.mu.Unlock()
+			dir = name
+			ack()
+			continue
+		}
+		ack()
+		data := make([]byte, size+1)
+		if _, err = io.ReadFull(in, data); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.files[name] = data[:size]
+		s.mu.Unlock()
+		ack()
+	}
+}
+
+func (s *SSH) sha256sum(home string, args []string, channel ssh.Channel) int {
+	status := 0
+	for _, arg := range args {
+		if arg == "--" {
+			continue
+		}
+		s.mu.Lock()
+		data, ok := s.files[expand(home, arg)]
+		s.mu.Unlock()
+		if !ok {
+			fmt.Fprintf(channel.Stderr(), "sha256sum: %s: No such file or directory\n", arg)
+			status = 1
+			continue
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(channel, "%s  %s\n", hex.EncodeToString(sum[:]), arg)
+	}
+	return status
+}
+
+// expand replaces a leading ~ with home.
+func expand(home, p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return home + p[1:]
+	}
+	return p
+}
+
+// split breaks a command into words, removing single quotes as a shell would.
+// A leading ~ is left for expand.
+func split(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for _, r := range command {
+		switch {
+		case quoted:
+			if r == '\'' {
+				quoted = false
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'':
+			quoted, inWord = true, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	if len(words) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return words, nil
+}
@@ -0,0 +1,161 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/amdonov/ami-builder/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+type orphan struct {
+	instance.Resource
+	buildID string
+	created time.Time
+}
+
+// Collect finds resources tagged by ami-builder that are older than maxAge
+// and deletes them. With dryRun set they are only listed.
+func Collect(ctx context.Context, ec2Service ec2iface.EC2API, maxAge time.Duration, dryRun bool) error {
+	orphans, err := find(ctx, ec2Service, time.Now().Add(-maxAge))
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		log.Println("No orphaned resources found")
+		return nil
+	}
+	// Record in creation order so the journal removes them in reverse
+	journal := &instance.Journal{}
+	for _, o := range orphans {
+		fmt.Printf("%s\t%s\t%s\n", o.Resource, o.buildID, o.created.Format(time.RFC3339))
+		journal.Record(o.Kind, o.ID)
+	}
+	if dryRun {
+		return nil
+	}
+	return journal.Rollback(ec2Service)
+}
+
+func find(ctx context.Context, ec2Service ec2iface.EC2API, cutoff time.Time) ([]orphan, error) {
+	var orphans []orphan
+	add := func(kind, id string, tags []*ec2.Tag, fallback *time.Time) {
+		created, ok := instance.CreatedAt(tags)
+		if !ok {
+			if fallback == nil {
+				return
+			}
+			created = *fallback
+		}
+		if created.Before(cutoff) {
+			orphans = append(orphans, orphan{instance.Resource{Kind: kind, ID: id}, buildID(tags), created})
+		}
+	}
+	filters := []*ec2.Filter{{
+		Name:   aws.String("tag:" + instance.ToolTag),
+		Values: []*string{aws.String(instance.ToolName)},
+	}}
+
+	keys, err := ec2Service.DescribeKeyPairsWithContext(ctx, &ec2.DescribeKeyPairsInput{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys.KeyPairs {
+		add(instance.KeyPair, *k.KeyName, k.Tags, k.CreateTime)
+	}
+
+	err = ec2Service.DescribeSecurityGroupsPagesWithContext(ctx, &ec2.DescribeSecurityGroupsInput{Filters: filters},
+		func(page *ec2.DescribeSecurityGroupsOutput, last bool) bool {
+			for _, sg := range page.SecurityGroups {
+				add(instance.SecurityGroup, *sg.GroupId, sg.Tags, nil)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	running := append(filters, &ec2.Filter{
+		Name:   aws.String("instance-state-name"),
+		Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+	})
+	err = ec2Service.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{Filters: running},
+		func(page *ec2.DescribeInstancesOutput, last bool) bool {
+			for _, r := range page.Reservations {
+				for _, i := range r.Instances {
+					add(instance.Instance, *i.InstanceId, i.Tags, i.LaunchTime)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = ec2Service.DescribeVolumesPagesWithContext(ctx, &ec2.DescribeVolumesInput{Filters: filters},
+		func(page *ec2.DescribeVolumesOutput, last bool) bool {
+			for _, v := range page.Volumes {
+				// Root volumes can't be detached and go with their instance
+				if len(v.Attachments) > 0 && aws.BoolValue(v.Attachments[0].DeleteOnTermination) {
+					continue
+				}
+				add(instance.Volume, *v.VolumeId, v.Tags, v.CreateTime)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots backing a registered AMI are the build's output, not orphans
+	inUse, err := imageSnapshots(ctx, ec2Service)
+	if err != nil {
+		return nil, err
+	}
+	err = ec2Service.DescribeSnapshotsPagesWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters:  filters,
+	}, func(page *ec2.DescribeSnapshotsOutput, last bool) bool {
+		for _, s := range page.Snapshots {
+			if !inUse[*s.SnapshotId] {
+				add(instance.Snapshot, *s.SnapshotId, s.Tags, s.StartTime)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+func imageSnapshots(ctx context.Context, ec2Service ec2iface.EC2API) (map[string]bool, error) {
+	images, err := ec2Service.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		Owners: []*string{aws.String("self")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make(map[string]bool)
+	for _, image := range images.Images {
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+				snapshots[*mapping.Ebs.SnapshotId] = true
+			}
+		}
+	}
+	return snapshots, nil
+}
+
+func buildID(tags []*ec2.Tag) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == instance.BuildIDTag {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
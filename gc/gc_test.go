@@ -0,0 +1,68 @@
+package gc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/amdonov/ami-builder/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// orphaned starts a bootstrap instance and abandons it as a crashed build would.
+func orphaned(t *testing.T) *fake.EC2 {
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	_, err := instance.Start(context.Background(), f, &instance.Config{
+		Subnets:  []string{"subnet-1"},
+		ImageID:  "ami-base",
+		Sizes:    []string{"t2.micro"},
+		SSHCIDRs: []string{"192.0.2.0/24"},
+		WorkDir:  t.TempDir(),
+	}, &instance.Journal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestCollect(t *testing.T) {
+	f := orphaned(t)
+	if err := Collect(context.Background(), f, -time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.KeyPairs) != 0 || len(f.SecurityGroups) != 0 {
+		t.Errorf("key pairs %v or security groups %v left behind", f.KeyPairs, f.SecurityGroups)
+	}
+	for id, i := range f.Instances {
+		if aws.StringValue(i.State.Name) != ec2.InstanceStateNameTerminated {
+			t.Errorf("instance %s is %s", id, aws.StringValue(i.State.Name))
+		}
+	}
+	// The tagged root volume goes with the instance rather than being detached
+	if len(f.Volumes) != 0 || f.Called("DetachVolume") != 0 {
+		t.Errorf("volumes %v left behind or detached", f.Volumes)
+	}
+}
+
+func TestCollectSkipsRecentResources(t *testing.T) {
+	f := orphaned(t)
+	if err := Collect(context.Background(), f, time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.KeyPairs) != 1 || len(f.SecurityGroups) != 1 {
+		t.Errorf("recent resources were removed")
+	}
+}
+
+func TestCollectDryRun(t *testing.T) {
+	f := orphaned(t)
+	if err := Collect(context.Background(), f, -time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+	if f.Called("TerminateInstances") != 0 || len(f.KeyPairs) != 1 {
+		t.Error("dry run removed resources")
+	}
+}
@@ -0,0 +1,70 @@
+package instance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Architectures an AMI can be built for
+const (
+	X86_64 = ec2.ArchitectureValuesX8664
+	ARM64  = ec2.ArchitectureValuesArm64
+)
+
+// Architecture returns arch, defaulting to x86_64.
+func Architecture(arch string) string {
+	if arch == "" {
+		return X86_64
+	}
+	return arch
+}
+
+// checkArchitecture makes sure the base AMI and every candidate size can run
+// arch. The image is built on the bootstrap machine, so it has to match.
+func checkArchitecture(ctx context.Context, ec2Service ec2iface.EC2API, config *Config) error {
+	arch := Architecture(config.Arch)
+	if arch != X86_64 && arch != ARM64 {
+		return fmt.Errorf("architecture %q isn't supported, use %s or %s", arch, X86_64, ARM64)
+	}
+	images, err := ec2Service.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(config.ImageID)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(images.Images) == 0 {
+		return fmt.Errorf("base AMI %s not found", config.ImageID)
+	}
+	if imageArch := aws.StringValue(images.Images[0].Architecture); imageArch != arch {
+		return fmt.Errorf("base AMI %s is %s, not %s", config.ImageID, imageArch, arch)
+	}
+	types, err := ec2Service.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: aws.StringSlice(config.Sizes),
+	})
+	if err != nil {
+		return err
+	}
+	var incompatible []string
+	for _, info := range types.InstanceTypes {
+		supported := false
+		if info.ProcessorInfo != nil {
+			for _, a := range info.ProcessorInfo.SupportedArchitectures {
+				supported = supported || aws.StringValue(a) == arch
+			}
+		}
+		if !supported {
+			incompatible = append(incompatible, aws.StringValue(info.InstanceType))
+		}
+	}
+	if len(incompatible) > 0 {
+		return fmt.Errorf("%s can't run %s images. Choose a size such as %s", strings.Join(incompatible, ", "), arch, exampleSize[arch])
+	}
+	return nil
+}
+
+var exampleSize = map[string]string{X86_64: "t3.micro", ARM64: "t4g.micro"}
@@ -0,0 +1,68 @@
+package instance
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func archConfig(t *testing.T, image, size string) *Config {
+	return &Config{
+		Subnets:  []string{"subnet-1"},
+		ImageID:  image,
+		Sizes:    []string{size},
+		SSHCIDRs: []string{"192.0.2.0/24"},
+		WorkDir:  t.TempDir(),
+		Arch:     ARM64,
+	}
+}
+
+func TestStartArm64(t *testing.T) {
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	f.AddBaseImage("ami-arm", ARM64)
+	server, err := Start(context.Background(), f, archConfig(t, "ami-arm", "t4g.micro"), &Journal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := f.Instances[*server.Instance.InstanceId]; aws.StringValue(i.InstanceType) != "t4g.micro" {
+		t.Errorf("launched %s", aws.StringValue(i.InstanceType))
+	}
+}
+
+func TestStartChecksArchitecture(t *testing.T) {
+	tests := []struct {
+		name, image, size, expected string
+	}{
+		{"x86 base image", "ami-x86", "t4g.micro", "ami-x86 is x86_64"},
+		{"x86 size", "ami-arm", "t2.micro", "t2.micro can't run arm64"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := fake.NewEC2()
+			f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+			f.AddBaseImage("ami-x86", X86_64)
+			f.AddBaseImage("ami-arm", ARM64)
+			_, err := Start(context.Background(), f, archConfig(t, test.image, test.size), &Journal{})
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Fatalf("expected %q, got %v", test.expected, err)
+			}
+			if f.Called("CreateKeyPair") != 0 || f.Called("RunInstances") != 0 {
+				t.Errorf("resources created before the check: %v", f.Calls)
+			}
+		})
+	}
+}
+
+func TestStartRejectsUnknownArchitecture(t *testing.T) {
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	config := archConfig(t, "ami-base", "t2.micro")
+	config.Arch = "sparc"
+	if _, err := Start(context.Background(), f, config, &Journal{}); err == nil || !strings.Contains(err.Error(), "sparc") {
+		t.Errorf("expected unsupported architecture, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Copy is a region the registered image is copied to. KMSKeyID re-encrypts
+// the copy with a key from that region. ImageID is set once the copy starts.
+type Copy struct {
+	Region   string
+	KMSKeyID string
+	ImageID  string
+}
+
+// ParseCopy reads a copy given as region or region=kms-key.
+func ParseCopy(spec string) (Copy, error) {
+	region, key := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		region, key = spec[:i], spec[i+1:]
+		if key == "" {
+			return Copy{}, fmt.Errorf("%q is missing the KMS key after =", spec)
+		}
+	}
+	if region == "" {
+		return Copy{}, fmt.Errorf("%q is missing the region", spec)
+	}
+	return Copy{Region: region, KMSKeyID: key}, nil
+}
+
+// Regional creates an EC2 client for region.
+type Regional func(region string) ec2iface.EC2API
+
+// ValidateCopies rejects copies to the source region, to a region twice or
+// without a way to reach the regions.
+func (c *Config) ValidateCopies() error {
+	if len(c.CopyTo) == 0 {
+		return nil
+	}
+	if c.Region == "" || c.Regional == nil {
+		return errors.New("copying to other regions requires Region and Regional")
+	}
+	seen := map[string]bool{c.Region: true}
+	for _, target := range c.CopyTo {
+		if target.Region == c.Region {
+			return fmt.Errorf("can't copy to %s, the image is built there", target.Region)
+		}
+		if seen[target.Region] {
+			return fmt.Errorf("%s is listed more than once", target.Region)
+		}
+		seen[target.Region] = true
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package instance
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+func TestParseCopy(t *testing.T) {
+	valid := map[string]Copy{
+		"us-west-2":                           {Region: "us-west-2"},
+		"us-gov-west-1=alias/dr":              {Region: "us-gov-west-1", KMSKeyID: "alias/dr"},
+		"eu-west-1=arn:aws:kms:eu-west-1:1:k": {Region: "eu-west-1", KMSKeyID: "arn:aws:kms:eu-west-1:1:k"},
+	}
+	for spec, expected := range valid {
+		if c, err := ParseCopy(spec); err != nil || c != expected {
+			t.Errorf("%s: got %+v, %v", spec, c, err)
+		}
+	}
+	for _, spec := range []string{"", "=alias/dr", "us-west-2="} {
+		if _, err := ParseCopy(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestValidateCopies(t *testing.T) {
+	regional := func(string) ec2iface.EC2API { return fake.NewEC2() }
+	valid := &Config{Region: "us-east-1", Regional: regional, CopyTo: []Copy{{Region: "us-west-2"}, {Region: "eu-west-1"}}}
+	if err := valid.ValidateCopies(); err != nil {
+		t.Error(err)
+	}
+	invalid := map[string]*Config{
+		"requires Region": {CopyTo: []Copy{{Region: "us-west-2"}}},
+		"built there":     {Region: "us-east-1", Regional: regional, CopyTo: []Copy{{Region: "us-east-1"}}},
+		"more than once":  {Region: "us-east-1", Regional: regional, CopyTo: []Copy{{Region: "us-west-2"}, {Region: "us-west-2"}}},
+	}
+	for message, config := range invalid {
+		if err := config.ValidateCopies(); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%v: expected %q, got %v", config.CopyTo, message, err)
+		}
+	}
+}
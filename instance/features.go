@@ -0,0 +1,72 @@
+package instance
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Boot modes an AMI can be built for
+const (
+	LegacyBIOS = ec2.BootModeValuesLegacyBios
+	UEFI       = ec2.BootModeValuesUefi
+)
+
+// Features are attributes of the registered image telling EC2 how to boot
+// and network the instances launched from it.
+type Features struct {
+	// BootMode is legacy-bios or uefi. It defaults to uefi for arm64, which
+	// can't boot any other way, and legacy-bios otherwise. The volume is
+	// partitioned to match.
+	BootMode string
+	// ImdsSupport v2.0 requires instances to use IMDSv2 tokens
+	ImdsSupport string
+	// EnaSupport and SriovNetSupport advertise enhanced networking.
+	// EnaSupport is always on for arm64, as every Graviton type needs it.
+	EnaSupport      bool
+	SriovNetSupport bool
+}
+
+// WithDefaults fills in the boot mode and networking for arch.
+func (f Features) WithDefaults(arch string) Features {
+	if f.BootMode == "" {
+		f.BootMode = LegacyBIOS
+		if Architecture(arch) == ARM64 {
+			f.BootMode = UEFI
+		}
+	}
+	if Architecture(arch) == ARM64 {
+		f.EnaSupport = true
+	}
+	return f
+}
+
+// Validate rejects features EC2 or the image for arch wouldn't support.
+func (f Features) Validate(arch string) error {
+	f = f.WithDefaults(arch)
+	switch {
+	case f.BootMode != LegacyBIOS && f.BootMode != UEFI:
+		return fmt.Errorf("boot mode %q isn't supported, use %s or %s", f.BootMode, LegacyBIOS, UEFI)
+	case f.BootMode == LegacyBIOS && Architecture(arch) == ARM64:
+		return fmt.Errorf("%s images can only boot with %s", ARM64, UEFI)
+	case f.ImdsSupport != "" && f.ImdsSupport != ec2.ImdsSupportValuesV20:
+		return fmt.Errorf("IMDS support %q isn't supported, use %s", f.ImdsSupport, ec2.ImdsSupportValuesV20)
+	}
+	return nil
+}
+
+// Register sets the features on the image being registered.
+func (f Features) Register(input *ec2.RegisterImageInput) {
+	f = f.WithDefaults(aws.StringValue(input.Architecture))
+	input.BootMode = aws.String(f.BootMode)
+	if f.ImdsSupport != "" {
+		input.ImdsSupport = aws.String(f.ImdsSupport)
+	}
+	if f.EnaSupport {
+		input.EnaSupport = aws.Bool(true)
+	}
+	if f.SriovNetSupport {
+		input.SriovNetSupport = aws.String("simple")
+	}
+}
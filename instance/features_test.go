@@ -0,0 +1,59 @@
+package instance
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestFeaturesValidate(t *testing.T) {
+	valid := []struct {
+		arch     string
+		features Features
+	}{
+		{"", Features{}},
+		{X86_64, Features{BootMode: UEFI, ImdsSupport: "v2.0", EnaSupport: true, SriovNetSupport: true}},
+		{ARM64, Features{}},
+		{ARM64, Features{BootMode: UEFI}},
+	}
+	for _, test := range valid {
+		if err := test.features.Validate(test.arch); err != nil {
+			t.Errorf("%s %+v: %v", test.arch, test.features, err)
+		}
+	}
+	invalid := map[string]struct {
+		arch     string
+		features Features
+	}{
+		"isn't supported, use legacy-bios": {X86_64, Features{BootMode: "uefi-preferred"}},
+		"can only boot with uefi":          {ARM64, Features{BootMode: LegacyBIOS}},
+		"IMDS support \"v1.0\"":            {X86_64, Features{ImdsSupport: "v1.0"}},
+	}
+	for message, test := range invalid {
+		if err := test.features.Validate(test.arch); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s %+v: expected %q, got %v", test.arch, test.features, message, err)
+		}
+	}
+}
+
+func TestFeaturesRegister(t *testing.T) {
+	input := &ec2.RegisterImageInput{Architecture: aws.String(ARM64)}
+	Features{ImdsSupport: "v2.0", EnaSupport: true, SriovNetSupport: true}.Register(input)
+	if aws.StringValue(input.BootMode) != UEFI || aws.StringValue(input.ImdsSupport) != "v2.0" ||
+		!aws.BoolValue(input.EnaSupport) || aws.StringValue(input.SriovNetSupport) != "simple" {
+		t.Errorf("unexpected input %v", input)
+	}
+	input = &ec2.RegisterImageInput{Architecture: aws.String(X86_64)}
+	Features{}.Register(input)
+	if aws.StringValue(input.BootMode) != LegacyBIOS || input.ImdsSupport != nil || input.EnaSupport != nil || input.SriovNetSupport != nil {
+		t.Errorf("unexpected input %v", input)
+	}
+	// Graviton instances only launch with ENA
+	input = &ec2.RegisterImageInput{Architecture: aws.String(ARM64)}
+	Features{}.Register(input)
+	if !aws.BoolValue(input.EnaSupport) || input.ImdsSupport != nil {
+		t.Errorf("unexpected input %v", input)
+	}
+}
@@ -0,0 +1,77 @@
+package instance
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+const (
+	beginFingerprints = "-----BEGIN SSH HOST KEY FINGERPRINTS-----"
+	endFingerprints   = "-----END SSH HOST KEY FINGERPRINTS-----"
+)
+
+// fingerprint matches SHA256 and legacy MD5 fingerprints as printed by ssh-keygen -l
+var fingerprint = regexp.MustCompile(`SHA256:[A-Za-z0-9+/]+=*|\b[0-9a-f]{2}(?::[0-9a-f]{2}){15}\b`)
+
+// ParseFingerprints extracts the host key fingerprints cloud-init prints to
+// the console. Console lines are often prefixed, e.g. with "ec2: ".
+func ParseFingerprints(output string) []string {
+	var fingerprints []string
+	inBlock := false
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.Contains(line, beginFingerprints):
+			inBlock = true
+			fingerprints = nil
+		case strings.Contains(line, endFingerprints):
+			if inBlock && len(fingerprints) > 0 {
+				return fingerprints
+			}
+			inBlock = false
+		case inBlock:
+			if f := fingerprint.FindString(line); f != "" {
+				fingerprints = append(fingerprints, f)
+			}
+		}
+	}
+	return nil
+}
+
+// hostKeyFingerprints polls the instance's console until cloud-init has
+// printed its host key fingerprints.
+func hostKeyFingerprints(ctx context.Context, ec2Service ec2iface.EC2API, instanceID *string) ([]string, error) {
+	log.Println("Waiting for host key fingerprints on the console")
+	for i := 0; i < 60; i = i + 1 {
+		resp, err := ec2Service.GetConsoleOutputWithContext(ctx, &ec2.GetConsoleOutputInput{
+			InstanceId: instanceID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Output != nil {
+			output, err := base64.StdEncoding.DecodeString(*resp.Output)
+			if err != nil {
+				return nil, err
+			}
+			if fingerprints := ParseFingerprints(string(output)); len(fingerprints) > 0 {
+				return fingerprints, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+	return nil, fmt.Errorf("no host key fingerprints found on the console of %s. Use --skip-host-key-check for images that don't print them",
+		aws.StringValue(instanceID))
+}
@@ -0,0 +1,68 @@
+package instance
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/ami-builder/fake"
+)
+
+const console = `[   12.345678] cloud-init[801]: Generating public/private rsa key pair.
+<14>Jan  2 03:04:05 ec2: 
+<14>Jan  2 03:04:05 ec2: #############################################################
+<14>Jan  2 03:04:05 ec2: -----BEGIN SSH HOST KEY FINGERPRINTS-----
+<14>Jan  2 03:04:05 ec2: 256 SHA256:2pDfAUkRqPIg4ZMSdsOFjlQ/aMVyPsMzTyDdThyV2Os root@ip-10-0-0-4 (ECDSA)
+<14>Jan  2 03:04:05 ec2: 2048 43:51:43:a1:b5:fc:8b:b7:0a:3a:a9:b1:0f:66:73:a8 root@ip-10-0-0-4 (RSA)
+<14>Jan  2 03:04:05 ec2: -----END SSH HOST KEY FINGERPRINTS-----
+<14>Jan  2 03:04:05 ec2: #############################################################
+-----BEGIN SSH HOST KEY KEYS-----
+ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTY= root@ip-10-0-0-4
+-----END SSH HOST KEY KEYS-----
+`
+
+func TestParseFingerprints(t *testing.T) {
+	expected := []string{
+		"SHA256:2pDfAUkRqPIg4ZMSdsOFjlQ/aMVyPsMzTyDdThyV2Os",
+		"43:51:43:a1:b5:fc:8b:b7:0a:3a:a9:b1:0f:66:73:a8",
+	}
+	if fingerprints := ParseFingerprints(console); !reflect.DeepEqual(fingerprints, expected) {
+		t.Errorf("expected %v, got %v", expected, fingerprints)
+	}
+	// An unfinished block is still being written
+	if fingerprints := ParseFingerprints(console[:strings.Index(console, endFingerprints)]); fingerprints != nil {
+		t.Errorf("expected no fingerprints, got %v", fingerprints)
+	}
+	if fingerprints := ParseFingerprints("Booting...\n"); fingerprints != nil {
+		t.Errorf("expected no fingerprints, got %v", fingerprints)
+	}
+}
+
+func TestStartPinsConsoleFingerprints(t *testing.T) {
+	_, server, _ := start(t)
+	host := server.Host()
+	if !reflect.DeepEqual(host.Fingerprints, []string{fake.ConsoleFingerprint}) {
+		t.Errorf("unexpected fingerprints %v", host.Fingerprints)
+	}
+}
+
+func TestStartSkipsHostKeyCheck(t *testing.T) {
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	f.ConsoleOutput = ""
+	server, err := Start(context.Background(), f, &Config{
+		Subnets:          []string{"subnet-1"},
+		ImageID:          "ami-base",
+		Sizes:            []string{"t2.micro"},
+		SSHCIDRs:         []string{"192.0.2.0/24"},
+		WorkDir:          t.TempDir(),
+		SkipHostKeyCheck: true,
+	}, &Journal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Called("GetConsoleOutput") != 0 || server.Host().Fingerprints != nil {
+		t.Error("host keys were checked")
+	}
+}
@@ -0,0 +1,106 @@
+package instance
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// EgressURL returns the caller's public IP address. It is used to restrict
+// SSH access when no CIDRs are given.
+var EgressURL = "https://checkip.amazonaws.com"
+
+// ParseCIDRs validates CIDR blocks, turning bare addresses into single host ranges.
+func ParseCIDRs(values []string) ([]string, error) {
+	var cidrs []string
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid SSH CIDR %q", value)
+			}
+			if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH CIDR %q", value)
+		}
+		cidrs = append(cidrs, ipNet.String())
+	}
+	return cidrs, nil
+}
+
+// EgressCIDR looks up the address the caller's traffic leaves from.
+func EgressCIDR(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("GET", EgressURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("unable to detect egress address, use --ssh-cidr: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	cidrs, err := ParseCIDRs([]string{string(body)})
+	if err != nil {
+		return "", fmt.Errorf("unable to detect egress address, use --ssh-cidr: %v", err)
+	}
+	return cidrs[0], nil
+}
+
+// vpcCIDRs returns every IPv4 and IPv6 block associated with a VPC.
+func vpcCIDRs(ctx context.Context, ec2Service ec2iface.EC2API, vpcID *string) ([]string, error) {
+	resp, err := ec2Service.DescribeVpcsWithContext(ctx, &ec2.DescribeVpcsInput{
+		VpcIds: []*string{vpcID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Vpcs) == 0 {
+		return nil, fmt.Errorf("vpc %s not found", aws.StringValue(vpcID))
+	}
+	vpc := resp.Vpcs[0]
+	cidrs := []string{aws.StringValue(vpc.CidrBlock)}
+	for _, assoc := range vpc.CidrBlockAssociationSet {
+		if cidr := aws.StringValue(assoc.CidrBlock); cidr != cidrs[0] {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	for _, assoc := range vpc.Ipv6CidrBlockAssociationSet {
+		cidrs = append(cidrs, aws.StringValue(assoc.Ipv6CidrBlock))
+	}
+	return cidrs, nil
+}
+
+// sshPermission allows SSH from each of the CIDRs.
+func sshPermission(cidrs []string) *ec2.IpPermission {
+	permission := &ec2.IpPermission{
+		IpProtocol: aws.String("tcp"),
+		FromPort:   aws.Int64(22),
+		ToPort:     aws.Int64(22),
+	}
+	for _, cidr := range cidrs {
+		if strings.Contains(cidr, ":") {
+			permission.Ipv6Ranges = append(permission.Ipv6Ranges, &ec2.Ipv6Range{CidrIpv6: aws.String(cidr)})
+		} else {
+			permission.IpRanges = append(permission.IpRanges, &ec2.IpRange{CidrIp: aws.String(cidr)})
+		}
+	}
+	return permission
+}
@@ -0,0 +1,108 @@
+package instance
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	cidrs, err := ParseCIDRs([]string{"198.51.100.7", "10.1.2.3/16", "2001:db8::1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"198.51.100.7/32", "10.1.0.0/16", "2001:db8::1/128", "2001:db8::/32"}
+	if !reflect.DeepEqual(cidrs, expected) {
+		t.Errorf("expected %v, got %v", expected, cidrs)
+	}
+	if _, err = ParseCIDRs([]string{"0.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+}
+
+// ingress returns the SSH ranges allowed by the only security group.
+func ingress(t *testing.T, f *fake.EC2) []string {
+	if len(f.SecurityGroups) != 1 {
+		t.Fatalf("expected one security group, got %v", f.SecurityGroups)
+	}
+	var cidrs []string
+	for _, sg := range f.SecurityGroups {
+		for _, permission := range sg.IpPermissions {
+			if aws.Int64Value(permission.FromPort) != 22 {
+				t.Errorf("unexpected port %d", aws.Int64Value(permission.FromPort))
+			}
+			for _, r := range permission.IpRanges {
+				cidrs = append(cidrs, aws.StringValue(r.CidrIp))
+			}
+			for _, r := range permission.Ipv6Ranges {
+				cidrs = append(cidrs, aws.StringValue(r.CidrIpv6))
+			}
+		}
+	}
+	return cidrs
+}
+
+func startWith(t *testing.T, config *Config) *fake.EC2 {
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	config.Subnets = []string{"subnet-1"}
+	config.ImageID = "ami-base"
+	config.Sizes = []string{"t2.micro"}
+	config.WorkDir = t.TempDir()
+	if _, err := Start(context.Background(), f, config, &Journal{}); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestStartAllowsGivenCIDRs(t *testing.T) {
+	f := startWith(t, &Config{SSHCIDRs: []string{"198.51.100.7", "2001:db8::/32"}})
+	expected := []string{"198.51.100.7/32", "2001:db8::/32"}
+	if cidrs := ingress(t, f); !reflect.DeepEqual(cidrs, expected) {
+		t.Errorf("expected %v, got %v", expected, cidrs)
+	}
+}
+
+func TestStartDefaultsToVPCWhenPrivate(t *testing.T) {
+	f := startWith(t, &Config{Private: true})
+	expected := []string{aws.StringValue(f.Vpcs["vpc-1"].CidrBlock)}
+	if cidrs := ingress(t, f); !reflect.DeepEqual(cidrs, expected) {
+		t.Errorf("expected %v, got %v", expected, cidrs)
+	}
+}
+
+func TestStartDefaultsToEgressAddress(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "198.51.100.7")
+	}))
+	defer ts.Close()
+	defer func(url string) { EgressURL = url }(EgressURL)
+	EgressURL = ts.URL
+
+	f := startWith(t, &Config{})
+	expected := []string{"198.51.100.7/32"}
+	if cidrs := ingress(t, f); !reflect.DeepEqual(cidrs, expected) {
+		t.Errorf("expected %v, got %v", expected, cidrs)
+	}
+}
+
+func TestStartRejectsInvalidCIDRs(t *testing.T) {
+	f := fake.NewEC2()
+	_, err := Start(context.Background(), f, &Config{
+		Subnets:  []string{"subnet-1"},
+		Sizes:    []string{"t2.micro"},
+		SSHCIDRs: []string{"bogus"},
+	}, &Journal{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(f.Calls) != 0 {
+		t.Errorf("AWS called before validation: %v", f.Calls)
+	}
+}
@@ -1,14 +1,23 @@
 package instance
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	myssh "github.com/amdonov/ami-builder/ssh"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
 func randomName() (res string, err error) {
@@ -23,133 +32,419 @@ func randomName() (res string, err error) {
 
 // Provisioner uses an SSH session to configure an AMI bootstrap instance.
 type Provisioner interface {
-	Provision(ip string, key []byte) error
+	Provision(ctx context.Context, host *myssh.Host) error
 }
 
 type Server struct {
-	Key           []byte
-	IPAddress     string
-	Instance      ec2.Instance
+	BuildID string
+	Key     []byte
+	// KeyFile is where a generated private key was written
+	KeyFile string
+	// WorkDir holds files for this build such as the key and build log
+	WorkDir   string
+	IPAddress string
+	Instance  ec2.Instance
+	// Market is spot or on-demand
+	Market        string
 	keyName       string
 	securityGroup *string
+	journal       *Journal
+	bastion       *myssh.Bastion
+	fingerprints  []string
+	sshTimeouts   myssh.Timeouts
+	log           *os.File
+}
+
+// Host returns how provisioners reach the server over SSH.
+func (s *Server) Host() *myssh.Host {
+	host := &myssh.Host{
+		Address:      s.IPAddress,
+		Key:          s.Key,
+		Bastion:      s.bastion,
+		Fingerprints: s.fingerprints,
+		Timeouts:     s.sshTimeouts,
+	}
+	if s.log != nil {
+		host.Log = s.log
+	}
+	return host
+}
+
+// OpenLog creates build.log in the work directory. Remote command output is
+// written to it once it's open. The caller must close it.
+func (s *Server) OpenLog() (io.Closer, error) {
+	f, err := os.OpenFile(filepath.Join(s.WorkDir, "build.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.log = f
+	log.Printf("Writing build log to %s", f.Name())
+	return f, nil
 }
 
 type Config struct {
-	Subnet   string
+	// Subnets and Sizes are candidates in order of preference. Each size
+	// is tried in every subnet before moving on to the next.
+	Subnets  []string
 	Name     string
 	ImageID  string
-	Size     string
+	Sizes    []string
 	UserData string
 	IAMRole  string
 	Private  bool
+	// SSHCIDRs limits SSH access to the bootstrap instance. It defaults to
+	// the VPC's CIDRs for private builds and the caller's address otherwise.
+	SSHCIDRs []string
+	// SecurityGroupIDs, KeyName and KeyFile reuse existing resources instead
+	// of creating temporary ones. KeyFile holds the private key for KeyName.
+	// InstanceProfile names an existing instance profile for the bootstrap
+	// machine. Resources the caller supplies are never removed.
+	SecurityGroupIDs []string
+	KeyName          string
+	KeyFile          string
+	InstanceProfile  string
+	// Spot requests the bootstrap machine as a spot instance, falling back
+	// to on-demand when spot capacity is unavailable. An empty
+	// SpotMaxPrice defaults to the on-demand price.
+	Spot         bool
+	SpotMaxPrice string
+	// Bastion relays SSH connections to the bootstrap machine
+	Bastion *myssh.Bastion
+	// KeyType is the type of key generated when KeyName isn't set, ed25519
+	// by default or rsa. It's written to a directory named after the build
+	// in WorkDir.
+	KeyType string
+	WorkDir string
+	// SkipHostKeyCheck trusts any host key. Otherwise the host keys must
+	// match the fingerprints cloud-init prints to the console.
+	SkipHostKeyCheck bool
+	// SSHTimeouts bound how long provisioners wait for SSH
+	SSHTimeouts myssh.Timeouts
+	// Storage is the AMI's root volume, DefaultStorage if not set
+	Storage Storage
+	// Arch is the AMI's architecture, x86_64 by default or arm64. ImageID
+	// and Sizes must match it.
+	Arch string
+	// Features are set on the registered image
+	Features Features
+	// CopyTo lists regions the registered image is copied to. Region is
+	// the build's own region and Regional creates clients for the others.
+	CopyTo   []Copy
+	Region   string
+	Regional Regional
+	// Sharing is applied to the image and each of its copies
+	Sharing Sharing
+	// Family groups the image with earlier builds for pruning. Images
+	// without one are never pruned.
+	Family string
+	// BootstrapIMDS is optional, the default, or required to make the
+	// bootstrap machine use IMDSv2 tokens. CentOS 7's cloud-init and the
+	// provision server's Ansible need optional.
+	BootstrapIMDS string
+}
+
+// keyType returns the generated key type, defaulting to ed25519.
+func keyType(t string) string {
+	if t == "" {
+		return ED25519
+	}
+	return t
+}
+
+// OnDemand is the market type of instances that aren't spot.
+const OnDemand = "on-demand"
+
+// spotUnavailable lists errors that mean a spot request can't be filled.
+var spotUnavailable = []string{
+	"InsufficientInstanceCapacity",
+	"MaxSpotInstanceCountExceeded",
+	"SpotMaxPriceTooLow",
+	"UnfulfillableCapacity",
+}
+
+// capacityErrors mean an instance type can't be launched in an AZ right now.
+var capacityErrors = []string{
+	"InsufficientInstanceCapacity",
+	"Unsupported",
+}
+
+// place launches the instance using the first size and subnet with capacity.
+func place(ctx context.Context, ec2Service ec2iface.EC2API, config *Config, params *ec2.RunInstancesInput) (*ec2.Instance, string, error) {
+	var err error
+	for _, size := range config.Sizes {
+		for _, subnet := range config.Subnets {
+			candidate := *params
+			nic := *params.NetworkInterfaces[0]
+			nic.SubnetId = aws.String(subnet)
+			candidate.NetworkInterfaces = []*ec2.InstanceNetworkInterfaceSpecification{&nic}
+			candidate.InstanceType = aws.String(size)
+			var instance *ec2.Instance
+			var market string
+			instance, market, err = launch(ctx, ec2Service, config, &candidate)
+			if err == nil {
+				return instance, market, nil
+			}
+			if !isCode(err, capacityErrors...) {
+				return nil, "", err
+			}
+			log.Printf("Unable to launch %s in %s: %v", size, subnet, err)
+		}
+	}
+	return nil, "", err
 }
 
-func CleanUp(ec2Service *ec2.EC2, instance *Server) error {
+// launch runs the instance as spot if requested, retrying as on-demand when
+// there's no spot capacity.
+func launch(ctx context.Context, ec2Service ec2iface.EC2API, config *Config, params *ec2.RunInstancesInput) (*ec2.Instance, string, error) {
+	if config.Spot {
+		spot := *params
+		options := &ec2.SpotMarketOptions{
+			SpotInstanceType:             aws.String(ec2.SpotInstanceTypeOneTime),
+			InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorTerminate),
+		}
+		if config.SpotMaxPrice != "" {
+			options.MaxPrice = aws.String(config.SpotMaxPrice)
+		}
+		spot.InstanceMarketOptions = &ec2.InstanceMarketOptionsRequest{
+			MarketType:  aws.String(ec2.MarketTypeSpot),
+			SpotOptions: options,
+		}
+		result, err := ec2Service.RunInstancesWithContext(ctx, &spot)
+		if err == nil {
+			return result.Instances[0], ec2.MarketTypeSpot, nil
+		}
+		if !isCode(err, spotUnavailable...) {
+			return nil, "", err
+		}
+		log.Printf("Spot capacity unavailable, falling back to on-demand: %v", err)
+	}
+	result, err := ec2Service.RunInstancesWithContext(ctx, params)
+	if err != nil {
+		return nil, "", err
+	}
+	return result.Instances[0], OnDemand, nil
+}
+
+func CleanUp(ctx context.Context, ec2Service ec2iface.EC2API, instance *Server) error {
 	// Terminate the machine
-	_, err := ec2Service.TerminateInstances(&ec2.TerminateInstancesInput{
+	_, err := ec2Service.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
 		InstanceIds: []*string{instance.Instance.InstanceId},
 	})
 	if err != nil {
 		return err
 	}
 	log.Println("Waiting for instance to terminate")
-	err = ec2Service.WaitUntilInstanceTerminated(&ec2.DescribeInstancesInput{
+	err = ec2Service.WaitUntilInstanceTerminatedWithContext(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{instance.Instance.InstanceId},
 	})
 	if err != nil {
 		return err
 	}
-	// Remove security group
-	_, err = ec2Service.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
-		GroupId: instance.securityGroup,
-	})
-	if err != nil {
-		return err
+	instance.journal.Forget(Instance, *instance.Instance.InstanceId)
+	// Remove security group unless it belongs to the caller
+	if instance.securityGroup != nil {
+		_, err = ec2Service.DeleteSecurityGroupWithContext(ctx, &ec2.DeleteSecurityGroupInput{
+			GroupId: instance.securityGroup,
+		})
+		if err != nil {
+			return err
+		}
+		instance.journal.Forget(SecurityGroup, *instance.securityGroup)
 	}
-	// Remove key
-	_, err = ec2Service.DeleteKeyPair(&ec2.DeleteKeyPairInput{KeyName: aws.String(instance.keyName)})
-	if err != nil {
-		return err
+	// Remove key unless it belongs to the caller
+	if instance.keyName != "" {
+		_, err = ec2Service.DeleteKeyPairWithContext(ctx, &ec2.DeleteKeyPairInput{KeyName: aws.String(instance.keyName)})
+		if err != nil {
+			return err
+		}
+		instance.journal.Forget(KeyPair, instance.keyName)
+	}
+	// The key is no longer needed once everything is cleaned up
+	if instance.KeyFile != "" {
+		if err = os.Remove(instance.KeyFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		instance.KeyFile = ""
 	}
+	// Leave the directory if anything else, such as the build log, is in it
+	os.Remove(instance.WorkDir)
 
 	return nil
 }
 
-func Start(ec2Service *ec2.EC2, config *Config) (*Server, error) {
-	// Create a key named bootstrap-Somenumber
-	keyName, err := randomName()
-	if err != nil {
-		return nil, err
+// SecurityGroupID returns the ID of the temporary security group, or an empty
+// string if existing groups were used.
+func (s *Server) SecurityGroupID() string {
+	return aws.StringValue(s.securityGroup)
+}
+
+// Start launches a bootstrap instance. Every resource it creates is recorded
+// in journal so the caller can roll them back if the build fails.
+func Start(ctx context.Context, ec2Service ec2iface.EC2API, config *Config, journal *Journal) (*Server, error) {
+	if (config.KeyName == "") != (config.KeyFile == "") {
+		return nil, errors.New("an existing key pair requires both a key name and a private key file")
 	}
-	resp, err := ec2Service.CreateKeyPair(&ec2.CreateKeyPairInput{KeyName: aws.String(keyName)})
+	var key []byte
+	if config.KeyFile != "" {
+		var err error
+		if key, err = ioutil.ReadFile(config.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Subnets) == 0 {
+		return nil, errors.New("subnet is required")
+	}
+	if len(config.Sizes) == 0 {
+		return nil, errors.New("size is required")
+	}
+	tokens := config.BootstrapIMDS
+	if tokens == "" {
+		tokens = ec2.HttpTokensStateOptional
+	}
+	if tokens != ec2.HttpTokensStateOptional && tokens != ec2.HttpTokensStateRequired {
+		return nil, fmt.Errorf("bootstrap IMDS %q isn't supported, use %s or %s", tokens, ec2.HttpTokensStateOptional, ec2.HttpTokensStateRequired)
+	}
+	cidrs, err := ParseCIDRs(config.SSHCIDRs)
 	if err != nil {
 		return nil, err
 	}
-	// Spit out the private key for debugging failures
-	fmt.Println(*resp.KeyMaterial)
 	// Lookup the VPC so both subnet and vpc aren't required as parameters
 	subnetReq := &ec2.DescribeSubnetsInput{
-		SubnetIds: []*string{aws.String(config.Subnet)},
+		SubnetIds: aws.StringSlice(config.Subnets),
 	}
-	subnetResp, err := ec2Service.DescribeSubnets(subnetReq)
+	subnetResp, err := ec2Service.DescribeSubnetsWithContext(ctx, subnetReq)
 	if err != nil {
 		return nil, err
 	}
 	vpc := subnetResp.Subnets[0].VpcId
-	sgName, err := randomName()
-	if err != nil {
+	// The security group only works within a single VPC
+	for _, subnet := range subnetResp.Subnets {
+		if *subnet.VpcId != *vpc {
+			return nil, fmt.Errorf("subnets %s and %s are in different VPCs", *subnetResp.Subnets[0].SubnetId, *subnet.SubnetId)
+		}
+	}
+	if err = checkArchitecture(ctx, ec2Service, config); err != nil {
 		return nil, err
 	}
-	// Create a security group with public SSH access
-	sgInput := &ec2.CreateSecurityGroupInput{
-		VpcId:       vpc,
-		Description: aws.String("Temporary SG for creating AMI"),
-		GroupName:   aws.String(sgName),
+	// Existing security groups already decide who may connect
+	if len(cidrs) == 0 && len(config.SecurityGroupIDs) == 0 {
+		if config.Private {
+			cidrs, err = vpcCIDRs(ctx, ec2Service, vpc)
+		} else {
+			var cidr string
+			cidr, err = EgressCIDR(ctx)
+			cidrs = []string{cidr}
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
-	sg, err := ec2Service.CreateSecurityGroup(sgInput)
+
+	// Name the key and security group bootstrap-Somenumber. The name also
+	// identifies the build in resource tags.
+	buildID, err := randomName()
 	if err != nil {
 		return nil, err
 	}
-	authInput := &ec2.AuthorizeSecurityGroupIngressInput{
-		CidrIp:     aws.String("0.0.0.0/0"),
-		GroupId:    sg.GroupId,
-		IpProtocol: aws.String("tcp"),
-		FromPort:   aws.Int64(22),
-		ToPort:     aws.Int64(22),
-	}
-	_, err = ec2Service.AuthorizeSecurityGroupIngress(authInput)
-	if err != nil {
+	workDir := filepath.Join(config.WorkDir, buildID)
+	if err = os.MkdirAll(workDir, 0700); err != nil {
 		return nil, err
 	}
+	keyName := config.KeyName
+	var createdKey, keyFile string
+	if keyName == "" {
+		keyName = buildID
+		var public []byte
+		key, public, err = GenerateKey(config.KeyType)
+		if err != nil {
+			return nil, err
+		}
+		// Keep the private key out of the logs. It stays on disk if the
+		// build fails for troubleshooting.
+		keyFile = filepath.Join(workDir, "id_"+keyType(config.KeyType))
+		if err = ioutil.WriteFile(keyFile, key, 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Bootstrap private key written to %s", keyFile)
+		_, err = ec2Service.ImportKeyPairWithContext(ctx, &ec2.ImportKeyPairInput{
+			KeyName:           aws.String(keyName),
+			PublicKeyMaterial: public,
+			TagSpecifications: TagSpecifications(buildID, ec2.ResourceTypeKeyPair),
+		})
+		if err != nil {
+			return nil, err
+		}
+		journal.Record(KeyPair, keyName)
+		createdKey = keyName
+	}
+	groups := aws.StringSlice(config.SecurityGroupIDs)
+	var createdGroup *string
+	if len(groups) == 0 {
+		log.Printf("Allowing SSH from %s", strings.Join(cidrs, ", "))
+		// Create a security group allowing SSH access
+		sgInput := &ec2.CreateSecurityGroupInput{
+			VpcId:             vpc,
+			Description:       aws.String("Temporary SG for creating AMI"),
+			GroupName:         aws.String(buildID),
+			TagSpecifications: TagSpecifications(buildID, ec2.ResourceTypeSecurityGroup),
+		}
+		sg, err := ec2Service.CreateSecurityGroupWithContext(ctx, sgInput)
+		if err != nil {
+			return nil, err
+		}
+		journal.Record(SecurityGroup, *sg.GroupId)
+		createdGroup = sg.GroupId
+		groups = []*string{sg.GroupId}
+		authInput := &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       sg.GroupId,
+			IpPermissions: []*ec2.IpPermission{sshPermission(cidrs)},
+		}
+		_, err = ec2Service.AuthorizeSecurityGroupIngressWithContext(ctx, authInput)
+		if err != nil {
+			return nil, err
+		}
+	}
 	// Provision a machine named bootstrap-Somenumber
 	instanceParams := &ec2.RunInstancesInput{
-		KeyName:      aws.String(keyName),
-		ImageId:      aws.String(config.ImageID),
-		InstanceType: aws.String(config.Size),
-		MaxCount:     aws.Int64(1),
-		MinCount:     aws.Int64(1),
+		KeyName:  aws.String(keyName),
+		ImageId:  aws.String(config.ImageID),
+		MaxCount: aws.Int64(1),
+		MinCount: aws.Int64(1),
 		NetworkInterfaces: []*ec2.InstanceNetworkInterfaceSpecification{
 			&ec2.InstanceNetworkInterfaceSpecification{
 				AssociatePublicIpAddress: aws.Bool(!config.Private),
 				DeviceIndex:              aws.Int64(0),
-				SubnetId:                 aws.String(config.Subnet),
-				Groups:                   []*string{sg.GroupId},
+				Groups:                   groups,
 			},
 		},
+		TagSpecifications: TagSpecifications(buildID, ec2.ResourceTypeInstance, ec2.ResourceTypeVolume),
+		// Requiring IMDSv2 keeps the bootstrap machine's credentials from
+		// forged requests, where its image supports it
+		MetadataOptions: &ec2.InstanceMetadataOptionsRequest{
+			HttpEndpoint: aws.String(ec2.InstanceMetadataEndpointStateEnabled),
+			HttpTokens:   aws.String(tokens),
+		},
 	}
-	if config.IAMRole != "" {
+	profile := config.IAMRole
+	if config.InstanceProfile != "" {
+		profile = config.InstanceProfile
+	}
+	if profile != "" {
 		instanceParams.SetIamInstanceProfile(&ec2.IamInstanceProfileSpecification{
-			Name: aws.String(config.IAMRole),
+			Name: aws.String(profile),
 		})
 	}
 	if config.UserData != "" {
 		instanceParams.SetUserData(config.UserData)
 	}
-	result, err := ec2Service.RunInstances(instanceParams)
+	launched, market, err := place(ctx, ec2Service, config, instanceParams)
 	if err != nil {
 		return nil, err
 	}
-	instance := *result.Instances[0]
+	instance := *launched
+	journal.Record(Instance, *instance.InstanceId)
+	log.Printf("Launched %s %s instance %s in %s", market, *instance.InstanceType, *instance.InstanceId,
+		*instance.Placement.AvailabilityZone)
 
 	var ipAddress string
 	if config.Private {
@@ -157,7 +452,7 @@ func Start(ec2Service *ec2.EC2, config *Config) (*Server, error) {
 	} else {
 		log.Println("Waiting for public IP")
 		for i := 0; i < 10; i = i + 1 {
-			interfaceDetails, err := ec2Service.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+			interfaceDetails, err := ec2Service.DescribeNetworkInterfacesWithContext(ctx, &ec2.DescribeNetworkInterfacesInput{
 				NetworkInterfaceIds: []*string{instance.NetworkInterfaces[0].NetworkInterfaceId},
 			})
 			if err != nil {
@@ -168,24 +463,42 @@ func Start(ec2Service *ec2.EC2, config *Config) (*Server, error) {
 				ipAddress = *iface.Association.PublicIp
 				break
 			}
-			time.Sleep(10 * time.Second)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(10 * time.Second):
+			}
 		}
 	}
 
 	log.Println("Waiting for instance to start")
-	if err = ec2Service.WaitUntilInstanceRunning(&ec2.DescribeInstancesInput{
-		InstanceIds: []*string{result.Instances[0].InstanceId},
+	if err = ec2Service.WaitUntilInstanceRunningWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{instance.InstanceId},
 	}); err != nil {
 		return nil, err
 	}
+	var fingerprints []string
+	if config.SkipHostKeyCheck {
+		log.Println("Host key verification disabled")
+	} else if fingerprints, err = hostKeyFingerprints(ctx, ec2Service, instance.InstanceId); err != nil {
+		return nil, err
+	}
 
 	// Everything is good return data to caller
 	ai := &Server{
+		BuildID:       buildID,
 		Instance:      instance,
 		IPAddress:     ipAddress,
-		securityGroup: sg.GroupId,
-		keyName:       keyName,
-		Key:           []byte(*resp.KeyMaterial),
+		Market:        market,
+		securityGroup: createdGroup,
+		keyName:       createdKey,
+		journal:       journal,
+		bastion:       config.Bastion,
+		fingerprints:  fingerprints,
+		sshTimeouts:   config.SSHTimeouts,
+		Key:           key,
+		KeyFile:       keyFile,
+		WorkDir:       workDir,
 	}
 	return ai, nil
 }
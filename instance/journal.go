@@ -0,0 +1,135 @@
+package instance
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Kinds of temporary resources tracked by a Journal
+const (
+	KeyPair       = "key pair"
+	SecurityGroup = "security group"
+	Instance      = "instance"
+	Volume        = "volume"
+	Snapshot      = "snapshot"
+)
+
+// Resource is an AWS resource created while building an AMI.
+type Resource struct {
+	Kind string
+	ID   string
+}
+
+func (r Resource) String() string {
+	return fmt.Sprintf("%s %s", r.Kind, r.ID)
+}
+
+// Journal records temporary resources as they are created so they can be
+// torn down if the build fails.
+type Journal struct {
+	resources []Resource
+}
+
+// Record adds a newly created resource to the journal.
+func (j *Journal) Record(kind, id string) {
+	j.resources = append(j.resources, Resource{kind, id})
+}
+
+// Forget removes a resource that has been deleted or is meant to outlive the build.
+func (j *Journal) Forget(kind, id string) {
+	for i, r := range j.resources {
+		if r.Kind == kind && r.ID == id {
+			j.resources = append(j.resources[:i], j.resources[i+1:]...)
+			return
+		}
+	}
+}
+
+// Resources returns the resources still recorded in the journal.
+func (j *Journal) Resources() []Resource {
+	return append([]Resource(nil), j.resources...)
+}
+
+// Rollback deletes every recorded resource in reverse order of creation. It
+// keeps going when a deletion fails and returns an error summarizing what
+// could not be removed.
+func (j *Journal) Rollback(ec2Service ec2iface.EC2API) error {
+	var failed []string
+	for i := len(j.resources) - 1; i >= 0; i-- {
+		r := j.resources[i]
+		log.Printf("Removing %s", r)
+		if err := remove(ec2Service, r); err != nil {
+			log.Printf("Unable to remove %s: %v", r, err)
+			failed = append(failed, fmt.Sprintf("%s (%v)", r, err))
+			continue
+		}
+		j.resources = append(j.resources[:i], j.resources[i+1:]...)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove %d resource(s): %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func remove(ec2Service ec2iface.EC2API, r Resource) error {
+	id := aws.String(r.ID)
+	switch r.Kind {
+	case KeyPair:
+		_, err := ec2Service.DeleteKeyPair(&ec2.DeleteKeyPairInput{KeyName: id})
+		return err
+	case SecurityGroup:
+		_, err := ec2Service.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{GroupId: id})
+		return err
+	case Instance:
+		_, err := ec2Service.TerminateInstances(&ec2.TerminateInstancesInput{
+			InstanceIds: []*string{id},
+		})
+		if err != nil {
+			return err
+		}
+		// Security groups can't be removed while the instance exists
+		return ec2Service.WaitUntilInstanceTerminated(&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{id},
+		})
+	case Volume:
+		// The volume may still be attached to the bootstrap instance
+		_, err := ec2Service.DetachVolume(&ec2.DetachVolumeInput{
+			VolumeId: id,
+			Force:    aws.Bool(true),
+		})
+		if err != nil && !isCode(err, "IncorrectState") {
+			return err
+		}
+		err = ec2Service.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{id},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = ec2Service.DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: id})
+		return err
+	case Snapshot:
+		_, err := ec2Service.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: id})
+		return err
+	}
+	return fmt.Errorf("unknown resource kind %q", r.Kind)
+}
+
+func isCode(err error, codes ...string) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if awsErr.Code() == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+package instance
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func start(t *testing.T) (*fake.EC2, *Server, *Journal) {
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	journal := &Journal{}
+	server, err := Start(context.Background(), f, &Config{
+		Subnets:  []string{"subnet-1"},
+		ImageID:  "ami-base",
+		Sizes:    []string{"t2.micro"},
+		SSHCIDRs: []string{"192.0.2.0/24"},
+		WorkDir:  t.TempDir(),
+	}, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, server, journal
+}
+
+func TestStartRecordsResources(t *testing.T) {
+	f, server, journal := start(t)
+	resources := journal.Resources()
+	if len(resources) != 3 {
+		t.Fatalf("expected 3 resources, got %v", resources)
+	}
+	for i, kind := range []string{KeyPair, SecurityGroup, Instance} {
+		if resources[i].Kind != kind {
+			t.Errorf("resource %d is %s, expected %s", i, resources[i].Kind, kind)
+		}
+	}
+	if server.IPAddress == "" {
+		t.Error("public IP not set")
+	}
+	i := f.Instances[*server.Instance.InstanceId]
+	if aws.StringValue(i.State.Name) != ec2.InstanceStateNameRunning {
+		t.Errorf("instance is %s", aws.StringValue(i.State.Name))
+	}
+	if _, ok := CreatedAt(i.Tags); !ok {
+		t.Error("instance is missing build tags")
+	}
+}
+
+func TestCleanUp(t *testing.T) {
+	f, server, journal := start(t)
+	keyFile := server.KeyFile
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("private key not written: %v", err)
+	}
+	if err := CleanUp(context.Background(), f, server); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(keyFile)); !os.IsNotExist(err) {
+		t.Errorf("work directory left behind: %v", err)
+	}
+	if len(journal.Resources()) != 0 {
+		t.Errorf("journal still has %v", journal.Resources())
+	}
+	if len(f.KeyPairs) != 0 || len(f.SecurityGroups) != 0 {
+		t.Errorf("key pairs %v or security groups %v left behind", f.KeyPairs, f.SecurityGroups)
+	}
+}
+
+func TestRollbackRemovesInReverse(t *testing.T) {
+	f, _, journal := start(t)
+	if err := journal.Rollback(f); err != nil {
+		t.Fatal(err)
+	}
+	// The security group can only go once the instance has terminated
+	var removals []string
+	for _, call := range f.Calls {
+		if strings.HasPrefix(call, "Delete") || strings.HasPrefix(call, "Terminate") {
+			removals = append(removals, call)
+		}
+	}
+	expected := []string{"TerminateInstances", "DeleteSecurityGroup", "DeleteKeyPair"}
+	if strings.Join(removals, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v, got %v", expected, removals)
+	}
+	if len(journal.Resources()) != 0 || len(f.KeyPairs) != 0 || len(f.SecurityGroups) != 0 {
+		t.Errorf("left behind %v", journal.Resources())
+	}
+}
+
+func TestRollbackReportsFailures(t *testing.T) {
+	f, _, journal := start(t)
+	f.FailOn("DeleteSecurityGroup", awserr.New("DependencyViolation", "in use", nil))
+	err := journal.Rollback(f)
+	if err == nil || !strings.Contains(err.Error(), SecurityGroup) {
+		t.Fatalf("expected security group failure, got %v", err)
+	}
+	// Everything else is still removed
+	if len(f.KeyPairs) != 0 {
+		t.Errorf("key pairs left behind: %v", f.KeyPairs)
+	}
+	resources := journal.Resources()
+	if len(resources) != 1 || resources[0].Kind != SecurityGroup {
+		t.Errorf("expected only the security group to remain, got %v", resources)
+	}
+	if err = journal.Rollback(f); err != nil {
+		t.Errorf("second rollback failed: %v", err)
+	}
+}
+
+func TestCleanUpLeavesCallerResources(t *testing.T) {
+	ctx := context.Background()
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	if _, err := f.CreateKeyPairWithContext(ctx, &ec2.CreateKeyPairInput{KeyName: aws.String("mine")}); err != nil {
+		t.Fatal(err)
+	}
+	sg, err := f.CreateSecurityGroupWithContext(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName: aws.String("mine"),
+		VpcId:     aws.String("vpc-1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "mine.pem")
+	if err = ioutil.WriteFile(keyFile, []byte("private key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	journal := &Journal{}
+	server, err := Start(ctx, f, &Config{
+		Subnets:          []string{"subnet-1"},
+		ImageID:          "ami-base",
+		Sizes:            []string{"t2.micro"},
+		SecurityGroupIDs: []string{*sg.GroupId},
+		KeyName:          "mine",
+		KeyFile:          keyFile,
+		InstanceProfile:  "existing",
+	}, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(server.Key) != "private key" {
+		t.Errorf("unexpected key %q", server.Key)
+	}
+	if f.Called("CreateKeyPair") != 1 || f.Called("CreateSecurityGroup") != 1 || f.Called("AuthorizeSecurityGroupIngress") != 0 {
+		t.Errorf("unexpected calls %v", f.Calls)
+	}
+	i := f.Instances[*server.Instance.InstanceId]
+	if aws.StringValue(i.KeyName) != "mine" || aws.StringValue(i.SecurityGroups[0].GroupId) != *sg.GroupId {
+		t.Errorf("instance launched with key %s and groups %v", aws.StringValue(i.KeyName), i.SecurityGroups)
+	}
+	if aws.StringValue(i.IamInstanceProfile.Arn) != "existing" {
+		t.Errorf("instance profile %v", i.IamInstanceProfile)
+	}
+	if resources := journal.Resources(); len(resources) != 1 || resources[0].Kind != Instance {
+		t.Errorf("expected only the instance in the journal, got %v", resources)
+	}
+	if err = CleanUp(ctx, f, server); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.KeyPairs) != 1 || len(f.SecurityGroups) != 1 {
+		t.Errorf("caller's key pairs %v or security groups %v removed", f.KeyPairs, f.SecurityGroups)
+	}
+}
+
+func TestStartRequiresKeyFile(t *testing.T) {
+	f := fake.NewEC2()
+	if _, err := Start(context.Background(), f, &Config{KeyName: "mine"}, &Journal{}); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestStartFallsBackToOnDemand(t *testing.T) {
+	f := fake.NewEC2()
+	f.AddSubnet("subnet-1", "vpc-1", "us-east-1a")
+	f.FailOn("RunInstances", awserr.New("InsufficientInstanceCapacity", "no spot capacity", nil))
+	server, err := Start(context.Background(), f, &Config{
+		Subnets:  []string{"subnet-1"},
+		ImageID:  "ami-base",
+		Sizes:    []string{"t2.micro"},
+		SSHCIDRs: []string{"192.0.2.0/24"},
+		WorkDir:  t.TempDir(),
+		Spot:     true,
+	}, &Journal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Market != OnDemand || f.Called("RunInstances") != 2 {
+		t.Errorf("market %s after %d launches", server.Market, f.Called("RunInstances"))
+	}
+	if server.Instance.InstanceLifecycle != nil {
+		t.Errorf("instance lifecycle %s", aws.StringValue(server.Instance.InstanceLifecycle))
+	}
+}
+
+func TestStartSetsBootstrapIMDS(t *testing.T) {
+	for imds, tokens := range map[string]string{
+		"":                          ec2.HttpTokensStateOptional,
+		ec2.HttpTokensStateOptional: ec2.HttpTokensStateOptional,
+		ec2.HttpTokensStateRequired: ec2.HttpTokensStateRequired,
+	} {
+		f := startWith(t, &Config{SSHCIDRs: []string{"192.0.2.0/24"}, BootstrapIMDS: imds})
+		for id, i := range f.Instances {
+			if i.MetadataOptions == nil || aws.StringValue(i.MetadataOptions.HttpTokens) != tokens {
+				t.Errorf("%q launched %s with %v", imds, id, i.MetadataOptions)
+			}
+		}
+	}
+}
+
+func TestStartRejectsUnknownBootstrapIMDS(t *testing.T) {
+	f := fake.NewEC2()
+	_, err := Start(context.Background(), f, &Config{
+		Subnets:       []string{"subnet-1"},
+		Sizes:         []string{"t2.micro"},
+		BootstrapIMDS: "v2",
+	}, &Journal{})
+	if err == nil || !strings.Contains(err.Error(), "bootstrap IMDS") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+	if len(f.Calls) != 0 {
+		t.Errorf("AWS called before validation: %v", f.Calls)
+	}
+}
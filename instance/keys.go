@@ -0,0 +1,103 @@
+package instance
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Types of generated bootstrap keys
+const (
+	ED25519 = "ed25519"
+	RSA     = "rsa"
+)
+
+// GenerateKey creates a private key in PEM form along with its public key in
+// authorized_keys form, suitable for ImportKeyPair.
+func GenerateKey(keyType string) (private, public []byte, err error) {
+	var signer ssh.Signer
+	switch keyType {
+	case ED25519, "":
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		if private, err = marshalED25519(pub, priv); err != nil {
+			return nil, nil, err
+		}
+		signer, err = ssh.NewSignerFromKey(&priv)
+	case RSA:
+		key, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return nil, nil, err
+		}
+		private = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		signer, err = ssh.NewSignerFromKey(key)
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, ssh.MarshalAuthorizedKey(signer.PublicKey()), nil
+}
+
+// marshalED25519 encodes an unencrypted private key in OpenSSH's format, the
+// only one ssh and OpenSSH agree on for ed25519. See PROTOCOL.key in the
+// OpenSSH sources.
+func marshalED25519(pub ed25519.PublicKey, priv ed25519.PrivateKey) ([]byte, error) {
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+	key := struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}{
+		Check1:  binary.BigEndian.Uint32(check),
+		Check2:  binary.BigEndian.Uint32(check),
+		Keytype: ssh.KeyAlgoED25519,
+		Pub:     pub,
+		Priv:    priv,
+	}
+	// Pad the private section to the cipher block size of 8
+	for i := 1; (len(ssh.Marshal(key)))%8 != 0; i++ {
+		key.Pad = append(key.Pad, byte(i))
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	body := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       sshPub.Marshal(),
+		PrivKeyBlock: ssh.Marshal(key),
+	})
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), body...),
+	}), nil
+}
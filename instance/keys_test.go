@@ -0,0 +1,27 @@
+package instance
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateKey(t *testing.T) {
+	for _, keyType := range []string{ED25519, RSA} {
+		private, public, err := GenerateKey(keyType)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		signer, err := ssh.ParsePrivateKey(private)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if !bytes.Equal(ssh.MarshalAuthorizedKey(signer.PublicKey()), public) {
+			t.Errorf("%s: public key doesn't match the private key", keyType)
+		}
+	}
+	if _, _, err := GenerateKey("dsa"); err == nil {
+		t.Error("expected an error for dsa")
+	}
+}
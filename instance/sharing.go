@@ -0,0 +1,45 @@
+package instance
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Sharing lists the accounts and AWS Organizations the image is shared
+// with. OrgARNs may name organizations or organizational units.
+type Sharing struct {
+	Accounts []string
+	OrgARNs  []string
+}
+
+var (
+	accountID = regexp.MustCompile(`^\d{12}$`)
+	orgARN    = regexp.MustCompile(`^arn:aws[a-z-]*:organizations::\d{12}:(organization|ou)/`)
+	ouARN     = regexp.MustCompile(`^arn:aws[a-z-]*:organizations::\d{12}:ou/`)
+)
+
+// Empty reports whether the image isn't shared.
+func (s Sharing) Empty() bool {
+	return len(s.Accounts) == 0 && len(s.OrgARNs) == 0
+}
+
+// Validate rejects malformed account IDs and ARNs.
+func (s Sharing) Validate() error {
+	for _, account := range s.Accounts {
+		if !accountID.MatchString(account) {
+			return fmt.Errorf("%q isn't a 12 digit account ID", account)
+		}
+	}
+	for _, arn := range s.OrgARNs {
+		if !orgARN.MatchString(arn) {
+			return fmt.Errorf("%q isn't an organization or organizational unit ARN", arn)
+		}
+	}
+	return nil
+}
+
+// IsOU reports whether arn names an organizational unit rather than an
+// organization.
+func IsOU(arn string) bool {
+	return ouARN.MatchString(arn)
+}
@@ -0,0 +1,153 @@
+package instance
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Storage describes the root volume of the AMI. It's used both to create
+// the volume that's provisioned and in the registered image's block device
+// mapping, so instances launched from the image get the same storage.
+type Storage struct {
+	// Size is in GiB
+	Size int64
+	Type string
+	// IOPS is required for io1 and io2 and optional for gp3
+	IOPS int64
+	// Throughput is in MiB/s and only applies to gp3
+	Throughput int64
+	Encrypted  bool
+	// KMSKeyID encrypts with a customer managed key instead of the default
+	KMSKeyID string
+}
+
+var DefaultStorage = Storage{Size: 20, Type: ec2.VolumeTypeGp2}
+
+// volumeLimits are the sizes and IOPS allowed for each volume type.
+var volumeLimits = map[string]struct {
+	minSize, maxSize, minIOPS, maxIOPS, iopsPerGiB int64
+}{
+	ec2.VolumeTypeGp2: {1, 16384, 0, 0, 0},
+	ec2.VolumeTypeGp3: {1, 16384, 3000, 16000, 500},
+	ec2.VolumeTypeIo1: {4, 16384, 100, 64000, 50},
+	ec2.VolumeTypeIo2: {4, 16384, 100, 64000, 500},
+}
+
+// minImageSize fits the scripts' layout: a 512M boot partition, a 200M EFI
+// system partition for UEFI, 12.5G of fixed logical volumes and a few GiB
+// left for root.
+const minImageSize = 16
+
+// gp3 throughput limits, and the baseline IOPS it's measured against when
+// none are given
+const (
+	minThroughput = 125
+	maxThroughput = 1000
+	gp3IOPS       = 3000
+	iopsPerMiBSec = 4
+)
+
+// WithDefaults fills in the size and type from DefaultStorage.
+func (v Storage) WithDefaults() Storage {
+	if v.Size == 0 {
+		v.Size = DefaultStorage.Size
+	}
+	if v.Type == "" {
+		v.Type = DefaultStorage.Type
+	}
+	return v
+}
+
+// Validate rejects combinations EC2 would refuse, so a build fails before
+// launching anything.
+func (v Storage) Validate() error {
+	v = v.WithDefaults()
+	limits, ok := volumeLimits[v.Type]
+	if !ok {
+		return fmt.Errorf("volume type %q isn't supported, use gp2, gp3, io1 or io2", v.Type)
+	}
+	if v.Size < limits.minSize || v.Size > limits.maxSize {
+		return fmt.Errorf("%s volumes must be between %d and %d GiB", v.Type, limits.minSize, limits.maxSize)
+	}
+	if v.Size < minImageSize {
+		return fmt.Errorf("the image's partitions and logical volumes need at least %d GiB", minImageSize)
+	}
+	switch {
+	case v.IOPS != 0 && limits.maxIOPS == 0:
+		return fmt.Errorf("%s volumes don't take IOPS", v.Type)
+	case v.IOPS == 0 && v.Type != ec2.VolumeTypeGp2 && v.Type != ec2.VolumeTypeGp3:
+		return fmt.Errorf("%s volumes require IOPS", v.Type)
+	case v.IOPS != 0 && (v.IOPS < limits.minIOPS || v.IOPS > limits.maxIOPS):
+		return fmt.Errorf("%s volumes must have between %d and %d IOPS", v.Type, limits.minIOPS, limits.maxIOPS)
+	case v.IOPS > limits.iopsPerGiB*v.Size:
+		return fmt.Errorf("%d IOPS is more than the %d per GiB allowed for a %d GiB %s volume", v.IOPS, limits.iopsPerGiB, v.Size, v.Type)
+	}
+	if v.Throughput != 0 {
+		if v.Type != ec2.VolumeTypeGp3 {
+			return fmt.Errorf("throughput only applies to gp3 volumes")
+		}
+		if v.Throughput < minThroughput || v.Throughput > maxThroughput {
+			return fmt.Errorf("throughput must be between %d and %d MiB/s", minThroughput, maxThroughput)
+		}
+		iops := v.IOPS
+		if iops == 0 {
+			iops = gp3IOPS
+		}
+		if v.Throughput*iopsPerMiBSec > iops {
+			return fmt.Errorf("%d MiB/s of throughput needs at least %d IOPS", v.Throughput, v.Throughput*iopsPerMiBSec)
+		}
+	}
+	if v.KMSKeyID != "" && !v.Encrypted {
+		return fmt.Errorf("a KMS key requires encryption")
+	}
+	return nil
+}
+
+// CreateVolumeInput creates the volume in the availability zone, tagged
+// for the build.
+func (v Storage) CreateVolumeInput(availabilityZone *string, buildID string) *ec2.CreateVolumeInput {
+	v = v.WithDefaults()
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone:  availabilityZone,
+		VolumeType:        aws.String(v.Type),
+		Size:              aws.Int64(v.Size),
+		TagSpecifications: TagSpecifications(buildID, ec2.ResourceTypeVolume),
+	}
+	if v.IOPS != 0 {
+		input.Iops = aws.Int64(v.IOPS)
+	}
+	if v.Throughput != 0 {
+		input.Throughput = aws.Int64(v.Throughput)
+	}
+	if v.Encrypted {
+		input.Encrypted = aws.Bool(true)
+	}
+	if v.KMSKeyID != "" {
+		input.KmsKeyId = aws.String(v.KMSKeyID)
+	}
+	return input
+}
+
+// EBS is the block device for the volume restored from snapshotID.
+func (v Storage) EBS(snapshotID string) *ec2.EbsBlockDevice {
+	v = v.WithDefaults()
+	ebs := &ec2.EbsBlockDevice{
+		DeleteOnTermination: aws.Bool(true),
+		SnapshotId:          aws.String(snapshotID),
+		VolumeSize:          aws.Int64(v.Size),
+		VolumeType:          aws.String(v.Type),
+	}
+	if v.IOPS != 0 {
+		ebs.Iops = aws.Int64(v.IOPS)
+	}
+	if v.Throughput != 0 {
+		ebs.Throughput = aws.Int64(v.Throughput)
+	}
+	// The snapshot keeps the volume's KMS key, which RegisterImage doesn't accept
+	if v.Encrypted {
+		ebs.Encrypted = aws.Bool(true)
+	}
+	return ebs
+}
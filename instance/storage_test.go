@@ -0,0 +1,60 @@
+package instance
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStorageValidate(t *testing.T) {
+	valid := []Storage{
+		{},
+		{Size: 16, Type: "gp3"},
+		{Size: 100, Type: "gp3", IOPS: 6000, Throughput: 500, Encrypted: true},
+		{Size: 20, Type: "io1", IOPS: 1000},
+		{Size: 20, Type: "io2", IOPS: 10000},
+		{Encrypted: true, KMSKeyID: "alias/ami"},
+	}
+	for _, storage := range valid {
+		if err := storage.Validate(); err != nil {
+			t.Errorf("%+v: %v", storage, err)
+		}
+	}
+	invalid := map[string]Storage{
+		"isn't supported":   {Type: "st1"},
+		"between 4 and":     {Size: 2, Type: "io1", IOPS: 100},
+		"at least 16 GiB":   {Size: 8, Type: "gp3"},
+		"don't take IOPS":   {IOPS: 3000},
+		"require IOPS":      {Type: "io2"},
+		"between 3000 and":  {Type: "gp3", IOPS: 1000},
+		"50 per GiB":        {Size: 20, Type: "io1", IOPS: 5000},
+		"only applies":      {Type: "io1", IOPS: 1000, Throughput: 250},
+		"between 125 and":   {Type: "gp3", Throughput: 2000},
+		"at least 4000":     {Type: "gp3", Throughput: 1000},
+		"requires encrypti": {KMSKeyID: "alias/ami"},
+	}
+	for message, storage := range invalid {
+		if err := storage.Validate(); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%+v: expected %q, got %v", storage, message, err)
+		}
+	}
+}
+
+func TestStorageBlockDevices(t *testing.T) {
+	storage := Storage{Size: 50, Type: "gp3", IOPS: 4000, Throughput: 250, Encrypted: true, KMSKeyID: "alias/ami"}
+	input := storage.CreateVolumeInput(nil, "bootstrap-1")
+	ebs := storage.EBS("snap-1")
+	if *input.Size != 50 || *ebs.VolumeSize != 50 || *input.VolumeType != "gp3" || *ebs.VolumeType != "gp3" {
+		t.Errorf("sizes or types differ: %v %v", input, ebs)
+	}
+	if *input.Iops != 4000 || *ebs.Iops != 4000 || *input.Throughput != 250 || *ebs.Throughput != 250 {
+		t.Errorf("performance differs: %v %v", input, ebs)
+	}
+	if !*input.Encrypted || !*ebs.Encrypted || *input.KmsKeyId != "alias/ami" || ebs.KmsKeyId != nil {
+		t.Errorf("unexpected encryption: %v %v", input, ebs)
+	}
+	// The defaults match the sizes previously hardcoded
+	input = Storage{}.CreateVolumeInput(nil, "bootstrap-1")
+	if *input.Size != 20 || *input.VolumeType != "gp2" || input.Iops != nil || input.Encrypted != nil {
+		t.Errorf("unexpected defaults %v", input)
+	}
+}
@@ -0,0 +1,51 @@
+package instance
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Tags applied to every resource created during a build so orphans can be
+// found and removed later
+const (
+	ToolTag    = "ami-builder:tool"
+	BuildIDTag = "ami-builder:build-id"
+	CreatedTag = "ami-builder:created"
+	ToolName   = "ami-builder"
+	// FamilyTag groups registered images for pruning
+	FamilyTag = "ami-builder:family"
+)
+
+// Tags returns the tags identifying resources created for a build.
+func Tags(buildID string) []*ec2.Tag {
+	return []*ec2.Tag{
+		{Key: aws.String(ToolTag), Value: aws.String(ToolName)},
+		{Key: aws.String(BuildIDTag), Value: aws.String(buildID)},
+		{Key: aws.String(CreatedTag), Value: aws.String(time.Now().UTC().Format(time.RFC3339))},
+	}
+}
+
+// TagSpecifications returns build tags for each of the given resource types.
+func TagSpecifications(buildID string, resourceTypes ...string) []*ec2.TagSpecification {
+	var specs []*ec2.TagSpecification
+	for _, resourceType := range resourceTypes {
+		specs = append(specs, &ec2.TagSpecification{
+			ResourceType: aws.String(resourceType),
+			Tags:         Tags(buildID),
+		})
+	}
+	return specs
+}
+
+// CreatedAt returns the creation time recorded in a resource's tags.
+func CreatedAt(tags []*ec2.Tag) (time.Time, bool) {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == CreatedTag {
+			t, err := time.Parse(time.RFC3339, aws.StringValue(tag.Value))
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,204 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/amdonov/ami-builder/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Policy decides which images of each family are kept. An image is kept if
+// it's one of the newest Keep or younger than MaxAge.
+type Policy struct {
+	// Family limits pruning to one family. All families are pruned if empty.
+	Family string
+	Keep   int
+	MaxAge time.Duration
+}
+
+// Prune deregisters images built by ami-builder that the policy doesn't
+// keep and deletes their snapshots. Images used by instances or launch
+// templates are always kept. With dryRun set the images are only listed.
+func Prune(ctx context.Context, ec2Service ec2iface.EC2API, policy Policy, dryRun bool) error {
+	if policy.Keep <= 0 && policy.MaxAge <= 0 {
+		return errors.New("a number of images to keep or an age is required, otherwise every image would be removed")
+	}
+	families, err := findFamilies(ctx, ec2Service, policy.Family)
+	if err != nil {
+		return err
+	}
+	inUse, err := usedImages(ctx, ec2Service)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-policy.MaxAge)
+	var stale []*ec2.Image
+	for _, images := range families {
+		newer := 0
+		for _, image := range images {
+			created, err := time.Parse(time.RFC3339, aws.StringValue(image.CreationDate))
+			if err != nil {
+				// Without a creation date the image's age and rank are unknown
+				log.Printf("Keeping %s, which has an unreadable creation date: %v", *image.ImageId, err)
+				continue
+			}
+			newer++
+			switch {
+			case newer <= policy.Keep:
+			case policy.MaxAge > 0 && created.After(cutoff):
+			case inUse[*image.ImageId] != "":
+				log.Printf("Keeping %s, which is used by %s", *image.ImageId, inUse[*image.ImageId])
+			default:
+				stale = append(stale, image)
+			}
+		}
+	}
+	if len(stale) == 0 {
+		log.Println("No images to prune")
+		return nil
+	}
+	for _, image := range stale {
+		fmt.Printf("%s\t%s\t%s\t%s\n", *image.ImageId, family(image), aws.StringValue(image.CreationDate), strings.Join(snapshots(image), ","))
+	}
+	if dryRun {
+		return nil
+	}
+	var failed []string
+	for _, image := range stale {
+		if err := remove(ctx, ec2Service, image); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", *image.ImageId, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to prune %d images: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// findFamilies groups the account's images by family, newest first.
+func findFamilies(ctx context.Context, ec2Service ec2iface.EC2API, only string) (map[string][]*ec2.Image, error) {
+	filters := []*ec2.Filter{{
+		Name:   aws.String("tag:" + instance.ToolTag),
+		Values: []*string{aws.String(instance.ToolName)},
+	}}
+	if only != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + instance.FamilyTag),
+			Values: []*string{aws.String(only)},
+		})
+	}
+	images, err := ec2Service.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		Owners:  []*string{aws.String("self")},
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+	families := make(map[string][]*ec2.Image)
+	for _, image := range images.Images {
+		// Images from before families were tagged are left alone
+		if f := family(image); f != "" {
+			families[f] = append(families[f], image)
+		}
+	}
+	for _, images := range families {
+		// RFC 3339 times in UTC sort as strings
+		sort.Slice(images, func(i, j int) bool {
+			return aws.StringValue(images[i].CreationDate) > aws.StringValue(images[j].CreationDate)
+		})
+	}
+	return families, nil
+}
+
+// usedImages maps images to an instance or launch template using them.
+func usedImages(ctx context.Context, ec2Service ec2iface.EC2API) (map[string]string, error) {
+	used := make(map[string]string)
+	// Stopped instances can be started again, which needs their image
+	err := ec2Service.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+		}},
+	}, func(page *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				used[aws.StringValue(i.ImageId)] = "instance " + aws.StringValue(i.InstanceId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	var templates []*ec2.LaunchTemplate
+	err = ec2Service.DescribeLaunchTemplatesPagesWithContext(ctx, &ec2.DescribeLaunchTemplatesInput{},
+		func(page *ec2.DescribeLaunchTemplatesOutput, last bool) bool {
+			templates = append(templates, page.LaunchTemplates...)
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	for _, template := range templates {
+		// Any version could still be launched, not just the default
+		err = ec2Service.DescribeLaunchTemplateVersionsPagesWithContext(ctx, &ec2.DescribeLaunchTemplateVersionsInput{
+			LaunchTemplateId: template.LaunchTemplateId,
+		}, func(page *ec2.DescribeLaunchTemplateVersionsOutput, last bool) bool {
+			for _, version := range page.LaunchTemplateVersions {
+				if data := version.LaunchTemplateData; data != nil && data.ImageId != nil {
+					used[*data.ImageId] = fmt.Sprintf("launch template %s version %d",
+						aws.StringValue(template.LaunchTemplateName), aws.Int64Value(version.VersionNumber))
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return used, nil
+}
+
+// remove deregisters the image, which must happen first, then deletes its
+// snapshots.
+func remove(ctx context.Context, ec2Service ec2iface.EC2API, image *ec2.Image) error {
+	_, err := ec2Service.DeregisterImageWithContext(ctx, &ec2.DeregisterImageInput{ImageId: image.ImageId})
+	if err != nil {
+		return err
+	}
+	log.Printf("Deregistered %s", *image.ImageId)
+	for _, id := range snapshots(image) {
+		if _, err = ec2Service.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(id)}); err != nil {
+			return fmt.Errorf("deregistered, but snapshot %s wasn't deleted: %v", id, err)
+		}
+		log.Printf("Deleted %s", id)
+	}
+	return nil
+}
+
+func family(image *ec2.Image) string {
+	for _, tag := range image.Tags {
+		if aws.StringValue(tag.Key) == instance.FamilyTag {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+func snapshots(image *ec2.Image) []string {
+	var ids []string
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+			ids = append(ids, *mapping.Ebs.SnapshotId)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,145 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/amdonov/ami-builder/fake"
+	"github.com/amdonov/ami-builder/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// register adds an image of family created age ago, backed by a snapshot,
+// as a finished build would leave it.
+func register(f *fake.EC2, family string, age time.Duration) string {
+	n := len(f.Images) + len(f.Snapshots)
+	imageID, snapshotID := fmt.Sprintf("ami-%d", n), fmt.Sprintf("snap-%d", n)
+	f.Snapshots[snapshotID] = &ec2.Snapshot{
+		SnapshotId: aws.String(snapshotID),
+		State:      aws.String(ec2.SnapshotStateCompleted),
+	}
+	tags := instance.Tags("build")
+	if family != "" {
+		tags = append(tags, &ec2.Tag{Key: aws.String(instance.FamilyTag), Value: aws.String(family)})
+	}
+	f.Images[imageID] = &ec2.Image{
+		ImageId:      aws.String(imageID),
+		State:        aws.String(ec2.ImageStateAvailable),
+		CreationDate: aws.String(time.Now().Add(-age).UTC().Format(time.RFC3339)),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+			DeviceName: aws.String("/dev/sda1"),
+			Ebs:        &ec2.EbsBlockDevice{SnapshotId: aws.String(snapshotID)},
+		}},
+		Tags: tags,
+	}
+	return imageID
+}
+
+func assertPruned(t *testing.T, f *fake.EC2, pruned, kept []string) {
+	t.Helper()
+	for _, id := range pruned {
+		if _, ok := f.Images[id]; ok {
+			t.Errorf("%s wasn't pruned", id)
+		}
+	}
+	for _, id := range kept {
+		if _, ok := f.Images[id]; !ok {
+			t.Errorf("%s was pruned", id)
+		}
+	}
+	if len(f.Snapshots) != len(f.Images) {
+		t.Errorf("%d snapshots left for %d images", len(f.Snapshots), len(f.Images))
+	}
+}
+
+func TestPruneKeepsNewest(t *testing.T) {
+	f := fake.NewEC2()
+	old := register(f, "base", 72*time.Hour)
+	older := register(f, "base", 96*time.Hour)
+	newer := register(f, "base", 48*time.Hour)
+	newest := register(f, "base", time.Hour)
+	// Each family keeps its own newest
+	other := register(f, "web", 200*time.Hour)
+	if err := Prune(context.Background(), f, Policy{Keep: 2}, false); err != nil {
+		t.Fatal(err)
+	}
+	assertPruned(t, f, []string{old, older}, []string{newer, newest, other})
+}
+
+func TestPruneKeepsRecent(t *testing.T) {
+	f := fake.NewEC2()
+	old := register(f, "base", 72*time.Hour)
+	recent := register(f, "base", time.Hour)
+	if err := Prune(context.Background(), f, Policy{MaxAge: 24 * time.Hour}, false); err != nil {
+		t.Fatal(err)
+	}
+	assertPruned(t, f, []string{old}, []string{recent})
+}
+
+func TestPruneOneFamily(t *testing.T) {
+	f := fake.NewEC2()
+	base := register(f, "base", 72*time.Hour)
+	web := register(f, "web", 72*time.Hour)
+	untagged := register(f, "", 72*time.Hour)
+	if err := Prune(context.Background(), f, Policy{Family: "base", MaxAge: time.Hour}, false); err != nil {
+		t.Fatal(err)
+	}
+	assertPruned(t, f, []string{base}, []string{web, untagged})
+}
+
+func TestPruneSkipsImagesInUse(t *testing.T) {
+	f := fake.NewEC2()
+	launched := register(f, "base", 72*time.Hour)
+	templated := register(f, "base", 72*time.Hour)
+	unused := register(f, "base", 72*time.Hour)
+	f.Instances["i-1"] = &ec2.Instance{
+		InstanceId: aws.String("i-1"),
+		ImageId:    aws.String(launched),
+		State:      &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameStopped)},
+	}
+	// Only an old version of the template uses the image
+	f.AddLaunchTemplate("lt-1", "ami-other", templated)
+	if err := Prune(context.Background(), f, Policy{MaxAge: time.Hour}, false); err != nil {
+		t.Fatal(err)
+	}
+	assertPruned(t, f, []string{unused}, []string{launched, templated})
+}
+
+func TestPruneKeepsImagesWithoutCreationDate(t *testing.T) {
+	f := fake.NewEC2()
+	newest := register(f, "base", time.Hour)
+	undated := register(f, "base", 72*time.Hour)
+	f.Images[undated].CreationDate = aws.String("yesterday")
+	missing := register(f, "base", 72*time.Hour)
+	f.Images[missing].CreationDate = nil
+	old := register(f, "base", 72*time.Hour)
+	// Undated images don't take the place of the newest
+	if err := Prune(context.Background(), f, Policy{Keep: 1}, false); err != nil {
+		t.Fatal(err)
+	}
+	assertPruned(t, f, []string{old}, []string{newest, undated, missing})
+}
+
+func TestPruneDryRun(t *testing.T) {
+	f := fake.NewEC2()
+	old := register(f, "base", 72*time.Hour)
+	if err := Prune(context.Background(), f, Policy{MaxAge: time.Hour}, true); err != nil {
+		t.Fatal(err)
+	}
+	assertPruned(t, f, nil, []string{old})
+	if f.Called("DeregisterImage") != 0 || f.Called("DeleteSnapshot") != 0 {
+		t.Errorf("dry run removed resources: %v", f.Calls)
+	}
+}
+
+func TestPruneRequiresPolicy(t *testing.T) {
+	f := fake.NewEC2()
+	old := register(f, "base", 72*time.Hour)
+	if err := Prune(context.Background(), f, Policy{Family: "base"}, false); err == nil {
+		t.Fatal("expected an error")
+	}
+	assertPruned(t, f, nil, []string{old})
+}
@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrConnectionLost is wrapped by errors from commands interrupted because
+// the peer stopped answering keepalives.
+var ErrConnectionLost = errors.New("connection lost")
+
+// keepAlive sends a keepalive request to conn every interval. If max requests
+// in a row go unanswered for an interval each, the peer is presumed dead and
+// the client closed. Any reply, even a refusal, shows the peer is alive.
+func (c *Client) keepAlive(conn ssh.Conn, addr string, interval time.Duration, max int) {
+	missed := 0
+	for {
+		if missed == 0 {
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-c.stop:
+			return
+		case err := <-reply:
+			if err != nil {
+				// Closed
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= max {
+				c.lose(fmt.Errorf("%w: %s didn't answer %d keepalives", ErrConnectionLost, addr, missed))
+				return
+			}
+		}
+	}
+}
+
+// lose records why the connection died and closes it, ending any sessions.
+func (c *Client) lose(err error) {
+	c.lostOnce.Do(func() {
+		log.Print(err)
+		c.lostErr = err
+		close(c.lost)
+		c.c.Close()
+		if c.bastion != nil {
+			c.bastion.Close()
+		}
+	})
+}
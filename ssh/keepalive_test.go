@@ -0,0 +1,134 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hangingServer accepts any key and runs commands that never finish. It
+// answers keepalives if answer is set and sends the signals it receives on
+// signals.
+func hangingServer(t *testing.T, answer bool, signals chan<- string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				continue
+			}
+			go func() {
+				for req := range reqs {
+					if answer {
+						req.Reply(false, nil)
+					}
+				}
+			}()
+			go func() {
+				for newChannel := range chans {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer channel.Close()
+						for req := range requests {
+							if req.Type == "signal" && signals != nil {
+								var msg struct{ Signal string }
+								ssh.Unmarshal(req.Payload, &msg)
+								signals <- msg.Signal
+							}
+							req.Reply(req.Type == "exec", nil)
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestKeepAliveDetectsDeadPeer(t *testing.T) {
+	client, err := Connect(context.Background(), "ec2-user", &Host{
+		Address:  hangingServer(t, false, nil),
+		Key:      testKey(t),
+		Timeouts: Timeouts{KeepAlive: 20 * time.Millisecond, KeepAliveMax: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	start := time.Now()
+	err = client.Run(context.Background(), "oscap", "oscap xccdf eval --remediate")
+	if !errors.Is(err, ErrConnectionLost) || !strings.HasPrefix(err.Error(), "oscap interrupted") {
+		t.Errorf("expected the connection to be lost, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dead peer detected after %s", elapsed)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	signals := make(chan string, 1)
+	client, err := Connect(context.Background(), "ec2-user", &Host{
+		Address:  hangingServer(t, true, signals),
+		Key:      testKey(t),
+		Timeouts: Timeouts{KeepAlive: 20 * time.Millisecond, Command: 100 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Run(context.Background(), "ami.sh", "yum --installroot /mnt/ami install -y @core")
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) || timeout.Phase != "ami.sh" {
+		t.Fatalf("expected ami.sh to time out, got %v", err)
+	}
+	if err.Error() != "ami.sh hung, no result after 100ms" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+	select {
+	case signal := <-signals:
+		if signal != string(ssh.SIGTERM) {
+			t.Errorf("sent %s", signal)
+		}
+	case <-time.After(time.Second):
+		t.Error("command not signalled")
+	}
+	// Keepalives were answered throughout, so the connection is still usable
+	select {
+	case <-client.lost:
+		t.Error(client.lostErr)
+	default:
+	}
+}
@@ -0,0 +1,134 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TailLines is how many lines of output a CommandError keeps.
+var TailLines = 20
+
+// CommandError reports a remote command that failed along with the end of
+// its output.
+type CommandError struct {
+	Phase string
+	// ExitStatus is -1 if the command ended without one, e.g. killed by a signal
+	ExitStatus int
+	Tail       []string
+	Err        error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("%s failed: %v", e.Phase, e.Err)
+	var timeout *TimeoutError
+	if errors.As(e.Err, &timeout) || errors.Is(e.Err, ErrConnectionLost) {
+		// Already names the phase
+		msg = e.Err.Error()
+	} else if e.ExitStatus >= 0 {
+		msg = fmt.Sprintf("%s exited with status %d", e.Phase, e.ExitStatus)
+	}
+	if len(e.Tail) == 0 {
+		return msg
+	}
+	return fmt.Sprintf("%s. Last %d lines of output:\n%s", msg, len(e.Tail), strings.Join(e.Tail, "\n"))
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// output writes remote output to out a line at a time, prefixed with a
+// timestamp, the phase and the stream. It keeps the last TailLines lines.
+type output struct {
+	mu    sync.Mutex
+	out   io.Writer
+	phase string
+	tail  []string
+}
+
+func (o *output) line(stream, text string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintf(o.out, "%s [%s] %s: %s\n", time.Now().Format("2006-01-02T15:04:05.000Z07:00"), o.phase, stream, text)
+	o.tail = append(o.tail, text)
+	if len(o.tail) > TailLines {
+		o.tail = o.tail[len(o.tail)-TailLines:]
+	}
+}
+
+// lastLines returns a copy of the tail.
+func (o *output) lastLines() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.tail...)
+}
+
+// stream returns a writer for one of the command's output streams.
+func (o *output) stream(name string) *lineWriter {
+	return &lineWriter{output: o, name: name}
+}
+
+type lineWriter struct {
+	output *output
+	name   string
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.output.line(w.name, strings.TrimRight(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// flush writes any final line without a newline.
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.output.line(w.name, string(w.buf))
+		w.buf = nil
+	}
+}
+
+// Run runs command remotely, writing its output to the console and build log
+// as it arrives. Failures are returned as a *CommandError.
+func (c *Client) Run(ctx context.Context, phase, command string) error {
+	o := &output{out: c.out, phase: phase}
+	stdout, stderr := o.stream("stdout"), o.stream("stderr")
+	err := c.RunCommand(ctx, phase, c.timeouts.Command, func(session *ssh.Session) error {
+		session.Stdout = stdout
+		session.Stderr = stderr
+		return session.Run(command)
+	})
+	if err != nil && err == ctx.Err() {
+		// The session may still be writing
+		return err
+	}
+	var timeout *TimeoutError
+	if errors.As(err, &timeout) || errors.Is(err, ErrConnectionLost) {
+		// As above, but show what it was doing when it stopped
+		return &CommandError{Phase: phase, ExitStatus: -1, Tail: o.lastLines(), Err: err}
+	}
+	stdout.flush()
+	stderr.flush()
+	if err == nil {
+		return nil
+	}
+	commandErr := &CommandError{Phase: phase, ExitStatus: -1, Tail: o.tail, Err: err}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		commandErr.ExitStatus = exitErr.ExitStatus()
+	}
+	return commandErr
+}
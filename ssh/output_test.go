@@ -0,0 +1,55 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestOutputLines(t *testing.T) {
+	var buf bytes.Buffer
+	o := &output{out: &buf, phase: "ami.sh"}
+	stdout, stderr := o.stream("stdout"), o.stream("stderr")
+	fmt.Fprint(stdout, "Installing pa")
+	fmt.Fprint(stderr, "warning: x\r\n")
+	fmt.Fprint(stdout, "ckages\nDone")
+	stdout.flush()
+	stderr.flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := []string{"[ami.sh] stderr: warning: x", "[ami.sh] stdout: Installing packages", "[ami.sh] stdout: Done"}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %q", len(expected), lines)
+	}
+	timestamp := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}\S* `)
+	for i, line := range lines {
+		if !timestamp.MatchString(line) || !strings.HasSuffix(line, expected[i]) {
+			t.Errorf("line %d is %q", i, line)
+		}
+	}
+}
+
+func TestOutputTail(t *testing.T) {
+	o := &output{out: &bytes.Buffer{}, phase: "ami.sh"}
+	for i := 0; i < TailLines+5; i++ {
+		o.line("stdout", fmt.Sprint(i))
+	}
+	if len(o.tail) != TailLines || o.tail[0] != "5" {
+		t.Errorf("unexpected tail %v", o.tail)
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	err := &CommandError{Phase: "ami.sh", ExitStatus: 2, Tail: []string{"yum: error", "exiting"}, Err: errors.New("Process exited with status 2")}
+	expected := "ami.sh exited with status 2. Last 2 lines of output:\nyum: error\nexiting"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+	err = &CommandError{Phase: "ami.sh", ExitStatus: -1, Err: errors.New("session closed")}
+	if err.Error() != "ami.sh failed: session closed" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
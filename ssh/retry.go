@@ -0,0 +1,106 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Timeouts bound how long Connect waits for a host and how long a
+// connection may go quiet. Zero values use the matching DefaultTimeouts value.
+type Timeouts struct {
+	// Connect is the overall deadline for establishing a connection
+	Connect time.Duration
+	// Dial and Handshake limit each attempt
+	Dial      time.Duration
+	Handshake time.Duration
+	// AuthAttempts is how many authentication failures are tolerated. A
+	// new instance can reject keys briefly while cloud-init installs them,
+	// but repeated failures usually mean the wrong user.
+	AuthAttempts int
+	// KeepAlive is how often the peer is checked, and KeepAliveMax how many
+	// checks it may miss before the connection is closed
+	KeepAlive    time.Duration
+	KeepAliveMax int
+	// Command limits each remote command. Zero means no limit.
+	Command time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	Connect:      5 * time.Minute,
+	Dial:         10 * time.Second,
+	Handshake:    30 * time.Second,
+	AuthAttempts: 3,
+	KeepAlive:    30 * time.Second,
+	KeepAliveMax: 3,
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Connect <= 0 {
+		t.Connect = DefaultTimeouts.Connect
+	}
+	if t.Dial <= 0 {
+		t.Dial = DefaultTimeouts.Dial
+	}
+	if t.Handshake <= 0 {
+		t.Handshake = DefaultTimeouts.Handshake
+	}
+	if t.AuthAttempts <= 0 {
+		t.AuthAttempts = DefaultTimeouts.AuthAttempts
+	}
+	if t.KeepAlive <= 0 {
+		t.KeepAlive = DefaultTimeouts.KeepAlive
+	}
+	if t.KeepAliveMax <= 0 {
+		t.KeepAliveMax = DefaultTimeouts.KeepAliveMax
+	}
+	return t
+}
+
+var (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// backoff returns the wait before retrying after attempt failures. It doubles
+// with every attempt up to maxBackoff, randomized so that concurrent builds
+// don't retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d := maxBackoff
+	if attempt < 5 {
+		d = minBackoff << uint(attempt)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Reasons a connection attempt failed
+const (
+	refused     = "connection refused"
+	timedOut    = "timed out"
+	authFailed  = "authentication failed"
+	unavailable = "unavailable"
+)
+
+// classify explains why a connection attempt failed.
+func classify(err error) string {
+	var netErr net.Error
+	var channelErr *ssh.OpenChannelError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return refused
+	case errors.As(err, &channelErr) && channelErr.Reason == ssh.ConnectionFailed:
+		// The bastion couldn't reach the host
+		return refused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return timedOut
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return authFailed
+	}
+	return unavailable
+}
@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		max := maxBackoff
+		if attempt < 5 {
+			max = minBackoff << uint(attempt)
+		}
+		if d := backoff(attempt); d < max/2 || d > max {
+			t.Errorf("attempt %d waits %s", attempt, d)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	// Find a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, err = net.Dial("tcp", addr)
+	if reason := classify(err); reason != refused {
+		t.Errorf("closed port classified as %s", reason)
+	}
+	if reason := classify(context.DeadlineExceeded); reason != timedOut {
+		t.Errorf("deadline classified as %s", reason)
+	}
+	authErr := errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain")
+	if reason := classify(authErr); reason != authFailed {
+		t.Errorf("auth error classified as %s", reason)
+	}
+}
+
+// silent accepts connections and never speaks, like a host that's still booting.
+func silent(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	config, err := clientConfig("ec2-user", testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Timeout = time.Second
+	_, err = dial(context.Background(), silent(t), config, 50*time.Millisecond, direct(config.Timeout))
+	if reason := classify(err); reason != timedOut {
+		t.Errorf("expected a timeout, got %s: %v", reason, err)
+	}
+}
+
+func TestConnectDeadline(t *testing.T) {
+	start := time.Now()
+	_, err := Connect(context.Background(), "ec2-user", &Host{
+		Address:  silent(t),
+		Key:      testKey(t),
+		Timeouts: Timeouts{Connect: 200 * time.Millisecond, Dial: 50 * time.Millisecond},
+	})
+	if err == nil || !strings.Contains(err.Error(), "not available") {
+		t.Errorf("expected the deadline to pass, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Connect took %s", elapsed)
+	}
+}
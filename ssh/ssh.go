@@ -1,55 +1,344 @@
 package ssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// Host describes how to reach a bootstrap machine.
+type Host struct {
+	// Address is a host name or IP with an optional port
+	Address string
+	Key     []byte
+	// Bastion, if set, relays the connection like ssh's ProxyJump
+	Bastion *Bastion
+	// Fingerprints pins the host keys. Any key is accepted if empty.
+	Fingerprints []string
+	Timeouts     Timeouts
+	// Log receives remote command output in addition to the console
+	Log io.Writer
+}
+
+// HostKeyError reports a host key that doesn't match the expected fingerprints.
+type HostKeyError struct {
+	Fingerprint string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key %s does not match the fingerprints on the console", e.Fingerprint)
+}
+
+// pin only accepts host keys with one of the fingerprints. The first
+// mismatch is stored in mismatch because the handshake hides its type.
+func pin(fingerprints []string, mismatch *error) func(string, net.Addr, ssh.PublicKey) error {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		sha256 := ssh.FingerprintSHA256(key)
+		md5 := ssh.FingerprintLegacyMD5(key)
+		for _, f := range fingerprints {
+			if f == sha256 || f == md5 {
+				return nil
+			}
+		}
+		*mismatch = &HostKeyError{sha256}
+		return *mismatch
+	}
+}
+
+// Bastion is a jump host with its own user and key.
+type Bastion struct {
+	User    string
+	Address string
+	Key     []byte
+}
+
+// ParseBastion reads a user@host[:port] bastion specification.
+func ParseBastion(spec string, key []byte) (*Bastion, error) {
+	at := strings.LastIndex(spec, "@")
+	if at < 1 || at == len(spec)-1 {
+		return nil, fmt.Errorf("bastion %q must be in the form user@host", spec)
+	}
+	return &Bastion{User: spec[:at], Address: withPort(spec[at+1:]), Key: key}, nil
+}
+
+// withPort adds the default SSH port to address unless it has one.
+func withPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), "22")
+}
+
 type Client struct {
 	c *ssh.Client
+	// bastion carries c and is closed with it
+	bastion *ssh.Client
+	// out receives the output of Run
+	out      io.Writer
+	timeouts Timeouts
+	// stop ends the keepalives
+	stop      chan struct{}
+	closeOnce sync.Once
+	// lost is closed, and lostErr set, when keepalives find the peer dead
+	lost     chan struct{}
+	lostErr  error
+	lostOnce sync.Once
+}
+
+func newClient(c, bastion *ssh.Client, out io.Writer, timeouts Timeouts) *Client {
+	client := &Client{
+		c:        c,
+		bastion:  bastion,
+		out:      out,
+		timeouts: timeouts,
+		stop:     make(chan struct{}),
+		lost:     make(chan struct{}),
+	}
+	go client.keepAlive(c, c.RemoteAddr().String(), timeouts.KeepAlive, timeouts.KeepAliveMax)
+	if bastion != nil {
+		go client.keepAlive(bastion, bastion.RemoteAddr().String(), timeouts.KeepAlive, timeouts.KeepAliveMax)
+	}
+	return client
+}
+
+// TimeoutError reports a remote command that didn't finish in time.
+type TimeoutError struct {
+	Phase   string
+	Timeout time.Duration
 }
 
-func (c *Client) RunCommand(operation func(*ssh.Session) error) error {
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s hung, no result after %s", e.Phase, e.Timeout)
+}
+
+// RunCommand runs operation in a new session. If ctx is cancelled or timeout,
+// when positive, passes first the remote command is signalled and the
+// session closed. Phase names the command in errors.
+func (c *Client) RunCommand(ctx context.Context, phase string, timeout time.Duration, operation func(*ssh.Session) error) error {
 	session, err := c.c.NewSession()
 	if err != nil {
-		return err
+		return c.interrupted(phase, err)
 	}
 	defer session.Close()
-	return operation(session)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- operation(session)
+	}()
+	select {
+	case err = <-done:
+		return c.interrupted(phase, err)
+	case <-expired:
+		session.Signal(ssh.SIGTERM)
+		session.Close()
+		return &TimeoutError{Phase: phase, Timeout: timeout}
+	case <-c.lost:
+		return c.interrupted(phase, err)
+	case <-ctx.Done():
+		session.Signal(ssh.SIGTERM)
+		session.Close()
+		return ctx.Err()
+	}
+}
+
+// interrupted replaces err with the reason the connection was lost, if it
+// was, since closing it leaves sessions with vague errors.
+func (c *Client) interrupted(phase string, err error) error {
+	select {
+	case <-c.lost:
+		return fmt.Errorf("%s interrupted: %w", phase, c.lostErr)
+	default:
+		return err
+	}
 }
 
 func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
 	c.c.Close()
+	if c.bastion != nil {
+		c.bastion.Close()
+	}
 }
 
-func Connect(user, ip string, key []byte) (*Client, error) {
+func clientConfig(user string, key []byte) (*ssh.ClientConfig, error) {
 	// Create the Signer for this private key.
 	signer, err := ssh.ParsePrivateKey(key)
 	if err != nil {
 		return nil, err
 	}
 
-	config := &ssh.ClientConfig{
+	return &ssh.ClientConfig{
 		User: user,
 		Auth: []ssh.AuthMethod{
 			// Use the PublicKeys method for remote authentication.
 			ssh.PublicKeys(signer),
 		},
+	}, nil
+}
+
+// Connect opens an SSH connection to host, retrying with backoff until the
+// host's connect timeout passes or ctx is cancelled.
+func Connect(ctx context.Context, user string, host *Host) (*Client, error) {
+	timeouts := host.Timeouts.withDefaults()
+	config, err := clientConfig(user, host.Key)
+	if err != nil {
+		return nil, err
+	}
+	config.Timeout = timeouts.Dial
+	var mismatch error
+	if len(host.Fingerprints) > 0 {
+		config.HostKeyCallback = pin(host.Fingerprints, &mismatch)
+	}
+	var bastionConfig *ssh.ClientConfig
+	if host.Bastion != nil {
+		if bastionConfig, err = clientConfig(host.Bastion.User, host.Bastion.Key); err != nil {
+			return nil, err
+		}
+		bastionConfig.Timeout = timeouts.Dial
 	}
 
-	// Connect to the remote server and perform the SSH handshake.
-	// Try every 10 seconds up to five minutes
-	var client *ssh.Client
-	for i := 0; i < 30; i = i + 1 {
-		client, err = ssh.Dial("tcp", fmt.Sprintf("%s:22", ip), config)
+	// Connect to the remote server and perform the SSH handshake
+	deadline, cancel := context.WithTimeout(ctx, timeouts.Connect)
+	defer cancel()
+	addr := withPort(host.Address)
+	var bastion *ssh.Client
+	closeBastion := func() {
+		if bastion != nil {
+			bastion.Close()
+		}
+	}
+	authFailures := 0
+	for attempt := 0; ; attempt++ {
+		var client *ssh.Client
+		if bastionConfig == nil {
+			client, err = dial(deadline, addr, config, timeouts.Handshake, direct(config.Timeout))
+		} else {
+			if bastion == nil {
+				// The bastion should already be up, but retry it all the same
+				bastion, err = dial(deadline, host.Bastion.Address, bastionConfig, timeouts.Handshake, direct(config.Timeout))
+			}
+			if bastion != nil {
+				client, err = dial(deadline, addr, config, timeouts.Handshake, bastion.Dial)
+				// Only a rejected channel shows the bastion is still up,
+				// otherwise it's dialed again on the next attempt
+				var rejected *ssh.OpenChannelError
+				if err != nil && !errors.As(err, &rejected) {
+					bastion.Close()
+					bastion = nil
+				}
+			}
+		}
 		if err == nil {
-			return &Client{client}, nil
+			out := io.Writer(os.Stdout)
+			if host.Log != nil {
+				out = io.MultiWriter(os.Stdout, host.Log)
+			}
+			return newClient(client, bastion, out, timeouts), nil
+		}
+		// A different host key won't fix itself
+		if mismatch != nil {
+			closeBastion()
+			return nil, mismatch
+		}
+		if ctx.Err() != nil {
+			closeBastion()
+			return nil, ctx.Err()
 		}
-		log.Println("SSH not available. Waiting...")
-		time.Sleep(10 * time.Second)
+		reason := classify(err)
+		if reason == authFailed {
+			authFailures++
+			if authFailures >= timeouts.AuthAttempts {
+				closeBastion()
+				return nil, fmt.Errorf("SSH authentication as %s failed %d times, check the user: %v", user, authFailures, err)
+			}
+		}
+		wait := backoff(attempt)
+		log.Printf("SSH %s (%v). Retrying in %s", reason, err, wait.Round(time.Second))
+		select {
+		case <-deadline.Done():
+			closeBastion()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("SSH not available after %s: %v", timeouts.Connect, err)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// direct returns a dialer that connects from this machine.
+func direct(timeout time.Duration) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		d := net.Dialer{Timeout: timeout}
+		return d.Dial(network, addr)
+	}
+}
+
+// dial connects to addr using dialer, either directly or through a bastion,
+// and performs the SSH handshake within handshake.
+func dial(ctx context.Context, addr string, config *ssh.ClientConfig, handshake time.Duration, dialer func(network, addr string) (net.Conn, error)) (*ssh.Client, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// Bastion channels have no dial timeout of their own
+	dialCtx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+	dialed := make(chan result, 1)
+	go func() {
+		conn, err := dialer("tcp", addr)
+		dialed <- result{conn, err}
+	}()
+	var conn net.Conn
+	select {
+	case r := <-dialed:
+		if r.err != nil {
+			return nil, r.err
+		}
+		conn = r.conn
+	case <-dialCtx.Done():
+		go func() {
+			if r := <-dialed; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, dialCtx.Err()
+	}
+	// Abandon the handshake if it takes too long or ctx is cancelled part way through
+	handshakeCtx, cancel := context.WithTimeout(ctx, handshake)
+	defer cancel()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-handshakeCtx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		if handshakeCtx.Err() != nil {
+			return nil, fmt.Errorf("handshake with %s: %w", addr, handshakeCtx.Err())
+		}
+		return nil, err
 	}
-	return nil, err
+	return ssh.NewClient(c, chans, reqs), nil
 }
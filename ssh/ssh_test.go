@@ -0,0 +1,182 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amdonov/ami-builder/fake"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseBastion(t *testing.T) {
+	for spec, expected := range map[string]Bastion{
+		"ec2-user@jump.example.com":    {User: "ec2-user", Address: "jump.example.com:22"},
+		"admin@198.51.100.7:2222":      {User: "admin", Address: "198.51.100.7:2222"},
+		"me@[2001:db8::1]":             {User: "me", Address: "[2001:db8::1]:22"},
+		"first.last@corp@jump.example": {User: "first.last@corp", Address: "jump.example:22"},
+	} {
+		bastion, err := ParseBastion(spec, nil)
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		if bastion.User != expected.User || bastion.Address != expected.Address {
+			t.Errorf("%s: expected %+v, got %+v", spec, expected, *bastion)
+		}
+	}
+	for _, spec := range []string{"jump.example.com", "@jump.example.com", "ec2-user@"} {
+		if _, err := ParseBastion(spec, nil); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestPin(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mismatch error
+	if err = pin([]string{"SHA256:other", ssh.FingerprintSHA256(key)}, &mismatch)("host", nil, key); err != nil {
+		t.Errorf("SHA256 fingerprint rejected: %v", err)
+	}
+	if err = pin([]string{ssh.FingerprintLegacyMD5(key)}, &mismatch)("host", nil, key); err != nil {
+		t.Errorf("MD5 fingerprint rejected: %v", err)
+	}
+	if mismatch != nil {
+		t.Errorf("unexpected mismatch %v", mismatch)
+	}
+	if err = pin([]string{"SHA256:other"}, &mismatch)("host", nil, key); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, ok := mismatch.(*HostKeyError); !ok {
+		t.Errorf("expected a host key error, got %v", mismatch)
+	}
+}
+
+// bastion relays direct-tcpip channels like sshd. Its first connection
+// rejects them, as if the target weren't up yet, then drops.
+func bastion(t *testing.T) (string, func() int) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mu sync.Mutex
+	connections := 0
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			connections++
+			first := connections == 1
+			mu.Unlock()
+			go relay(conn, config, first)
+		}
+	}()
+	return l.Addr().String(), func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return connections
+	}
+}
+
+func relay(conn net.Conn, config *ssh.ServerConfig, drop bool) {
+	server, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer server.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err = ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil || drop {
+			newChannel.Reject(ssh.ConnectionFailed, "connection refused")
+			if drop {
+				return
+			}
+			continue
+		}
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			remote.Close()
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		go func() {
+			defer channel.Close()
+			io.Copy(channel, remote)
+		}()
+		go func() {
+			defer remote.Close()
+			io.Copy(remote, channel)
+		}()
+	}
+}
+
+func TestConnectRedialsBastion(t *testing.T) {
+	defer func(wait time.Duration) { minBackoff = wait }(minBackoff)
+	minBackoff = time.Millisecond
+	key := testKey(t)
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := fake.NewSSH(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	addr, connections := bastion(t)
+	client, err := Connect(context.Background(), "ec2-user", &Host{
+		Address:      server.Addr,
+		Key:          key,
+		Bastion:      &Bastion{User: "jump", Address: addr, Key: key},
+		Fingerprints: []string{server.Fingerprint},
+		Timeouts:     Timeouts{Connect: 10 * time.Second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if n := connections(); n != 2 {
+		t.Errorf("bastion dialed %d times", n)
+	}
+}
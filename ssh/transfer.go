@@ -0,0 +1,317 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// UploadAttempts is how many times Upload tries a transfer before giving up.
+var UploadAttempts = 3
+
+// upload is a local file and where it ends up remotely.
+type upload struct {
+	local  string
+	remote string
+	sum    string
+}
+
+// Upload copies the local file or directory src to dst, the remote path of
+// the file or directory to create. Directories are copied recursively. Each
+// file's SHA-256 is checked remotely and failed transfers are retried.
+func (c *Client) Upload(ctx context.Context, src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	files, err := checksums(src, dst, info)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = c.send(ctx, src, dst, info)
+		if err == nil {
+			err = c.verify(ctx, files)
+		}
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrConnectionLost) {
+			return err
+		}
+		if attempt+1 >= UploadAttempts {
+			return fmt.Errorf("upload of %s failed after %d attempts: %v", src, attempt+1, err)
+		}
+		wait := backoff(attempt)
+		log.Printf("Upload of %s failed (%v). Retrying in %s", src, err, wait.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// checksums lists every file under src with its SHA-256 and remote path.
+func checksums(src, dst string, info os.FileInfo) ([]upload, error) {
+	if !info.IsDir() {
+		sum, err := sha256File(src)
+		if err != nil {
+			return nil, err
+		}
+		return []upload{{src, dst, sum}}, nil
+	}
+	var files []upload
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		sum, err := sha256File(p)
+		if err != nil {
+			return err
+		}
+		files = append(files, upload{p, path.Join(dst, filepath.ToSlash(rel)), sum})
+		return nil
+	})
+	return files, err
+}
+
+func sha256File(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// send runs the remote end of scp and streams src to it.
+func (c *Client) send(ctx context.Context, src, dst string, info os.FileInfo) error {
+	return c.RunCommand(ctx, "upload of "+src, c.timeouts.Command, func(session *ssh.Session) error {
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			return err
+		}
+		stdout, err := session.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		var stderr bytes.Buffer
+		session.Stderr = &stderr
+		cmd := "scp -t " + remotePath(dst)
+		if info.IsDir() {
+			// Copy the directory's contents into dst rather than a subdirectory
+			cmd = fmt.Sprintf("mkdir -p %s && scp -r -t %s", remotePath(dst), remotePath(dst))
+		}
+		if err = session.Start(cmd); err != nil {
+			return err
+		}
+		source := &scpSource{w: stdin, r: bufio.NewReader(stdout)}
+		if err = source.ack(); err == nil {
+			if info.IsDir() {
+				err = source.contents(src)
+			} else {
+				err = source.file(src, path.Base(dst), info)
+			}
+		}
+		stdin.Close()
+		if waitErr := session.Wait(); err == nil && waitErr != nil {
+			err = waitErr
+		}
+		if err != nil && stderr.Len() > 0 {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	})
+}
+
+// verify compares the remote SHA-256 of each file with the local one.
+func (c *Client) verify(ctx context.Context, files []upload) error {
+	if len(files) == 0 {
+		return nil
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = remotePath(f.remote)
+	}
+	var out bytes.Buffer
+	err := c.RunCommand(ctx, "checksum", c.timeouts.Command, func(session *ssh.Session) error {
+		session.Stdout = &out
+		return session.Run("sha256sum -- " + strings.Join(paths, " "))
+	})
+	if err != nil {
+		return fmt.Errorf("unable to checksum uploads: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(files) {
+		return fmt.Errorf("expected %d checksums, got %q", len(files), out.String())
+	}
+	for i, f := range files {
+		if fields := strings.Fields(lines[i]); len(fields) == 0 || fields[0] != f.sum {
+			return fmt.Errorf("checksum mismatch for %s", f.remote)
+		}
+	}
+	return nil
+}
+
+// remotePath quotes p for the remote shell, leaving a leading ~/ to be
+// expanded to the home directory.
+func remotePath(p string) string {
+	if strings.HasPrefix(p, "~/") {
+		return "~/" + quote(p[2:])
+	}
+	return quote(p)
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// scpSource speaks the sending side of the scp protocol.
+type scpSource struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// ack reads the sink's response to the last message.
+func (s *scpSource) ack() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := s.r.ReadString('\n')
+	return errors.New(strings.TrimSpace(msg))
+}
+
+func (s *scpSource) send(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+// file sends the local file at p to be named name.
+func (s *scpSource) file(p, name string, info os.FileInfo) error {
+	if strings.ContainsAny(name, "\n/") {
+		return fmt.Errorf("can't upload %q", p)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = s.send("C%04o %d %s\n", info.Mode().Perm(), info.Size(), name); err != nil {
+		return err
+	}
+	progress := newProgress(p, info.Size())
+	if _, err = io.Copy(s.w, io.TeeReader(f, progress)); err != nil {
+		return err
+	}
+	if err = s.send("\x00"); err != nil {
+		return err
+	}
+	progress.done()
+	return nil
+}
+
+// dir sends the local directory at p, and everything in it, to be named name.
+func (s *scpSource) dir(p, name string, info os.FileInfo) error {
+	if strings.ContainsAny(name, "\n/") {
+		return fmt.Errorf("can't upload %q", p)
+	}
+	if err := s.send("D%04o 0 %s\n", info.Mode().Perm(), name); err != nil {
+		return err
+	}
+	if err := s.contents(p); err != nil {
+		return err
+	}
+	return s.send("E\n")
+}
+
+// contents sends everything in the local directory p.
+func (s *scpSource) contents(p string) error {
+	entries, err := ioutil.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(p, entry.Name())
+		// Follow symlinks
+		info, err := os.Stat(child)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = s.dir(child, entry.Name(), info)
+		} else {
+			err = s.file(child, entry.Name(), info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// progress logs how much of a file has been sent every 10 percent.
+type progress struct {
+	name  string
+	total int64
+	sent  int64
+	next  int64
+	start time.Time
+}
+
+func newProgress(name string, total int64) *progress {
+	return &progress{name: name, total: total, next: 10, start: time.Now()}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.sent += int64(len(b))
+	if p.total > 0 {
+		for percent := p.sent * 100 / p.total; percent >= p.next && p.next < 100; p.next += 10 {
+			log.Printf("Uploading %s: %d%% of %s", p.name, p.next, size(p.total))
+		}
+	}
+	return len(b), nil
+}
+
+func (p *progress) done() {
+	log.Printf("Uploaded %s (%s) in %s", p.name, size(p.total), time.Since(p.start).Round(time.Millisecond))
+}
+
+// size formats a byte count for people.
+func size(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,195 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/ami-builder/fake"
+	"golang.org/x/crypto/ssh"
+)
+
+// sink receives scp messages, returning the files written by path.
+func sink(t *testing.T, r io.Reader, w io.Writer, reject string) map[string]string {
+	files := make(map[string]string)
+	in := bufio.NewReader(r)
+	var dirs []string
+	for {
+		line, err := in.ReadString('\n')
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Error(err)
+			return files
+		}
+		var mode, size int64
+		var name string
+		switch line[0] {
+		case 'D':
+			fmt.Sscanf(line, "D%o %d %s", &mode, &size, &name)
+			dirs = append(dirs, name)
+		case 'E':
+			dirs = dirs[:len(dirs)-1]
+		case 'C':
+			fmt.Sscanf(line, "C%o %d %s", &mode, &size, &name)
+			if name == reject {
+				fmt.Fprintf(w, "\x02scp: %s: Permission denied\n", name)
+				continue
+			}
+			w.Write([]byte{0})
+			data := make([]byte, size+1)
+			if _, err = io.ReadFull(in, data); err != nil {
+				t.Error(err)
+				return files
+			}
+			files[strings.Join(append(dirs, name), "/")] = string(data[:size])
+		}
+		w.Write([]byte{0})
+	}
+}
+
+func TestScpSource(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "roles", "common"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "site.yml"), []byte("- hosts: all\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "roles", "common", "main.yml"), []byte("tasks: []\n"), 0644)
+
+	messages, source := io.Pipe()
+	acks, ackWriter := io.Pipe()
+	received := make(chan map[string]string)
+	go func() { received <- sink(t, messages, ackWriter, "") }()
+	s := &scpSource{w: source, r: bufio.NewReader(acks)}
+	if err := s.contents(dir); err != nil {
+		t.Fatal(err)
+	}
+	source.Close()
+	expected := map[string]string{"site.yml": "- hosts: all\n", "roles/common/main.yml": "tasks: []\n"}
+	if files := <-received; !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+}
+
+func TestScpSourceRejected(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ami.sh")
+	ioutil.WriteFile(file, []byte("#!/bin/bash\n"), 0644)
+	info, _ := os.Stat(file)
+
+	messages, source := io.Pipe()
+	acks, ackWriter := io.Pipe()
+	go sink(t, messages, ackWriter, "ami.sh")
+	s := &scpSource{w: source, r: bufio.NewReader(acks)}
+	err := s.file(file, "ami.sh", info)
+	if err == nil || err.Error() != "scp: ami.sh: Permission denied" {
+		t.Errorf("unexpected error %v", err)
+	}
+	source.Close()
+}
+
+func TestChecksums(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "repo"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "repo", "empty"), nil, 0644)
+	info, _ := os.Stat(dir)
+	files, err := checksums(dir, "/tmp/upload", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []upload{{
+		filepath.Join(dir, "repo", "empty"),
+		"/tmp/upload/repo/empty",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+}
+
+func TestRemotePath(t *testing.T) {
+	for p, expected := range map[string]string{
+		"~/ami.sh":             `~/'ami.sh'`,
+		"/tmp/prov client.rpm": `'/tmp/prov client.rpm'`,
+		"/tmp/it's":            `'/tmp/it'\''s'`,
+	} {
+		if quoted := remotePath(p); quoted != expected {
+			t.Errorf("expected %s, got %s", expected, quoted)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	for n, expected := range map[int64]string{512: "512 B", 1536: "1.5 KiB", 27 << 20: "27.0 MiB"} {
+		if s := size(n); s != expected {
+			t.Errorf("expected %s, got %s", expected, s)
+		}
+	}
+}
+
+// connect starts a fake SSH server and connects to it as ec2-user.
+func connect(t *testing.T) (*fake.SSH, *Client) {
+	key := testKey(t)
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := fake.NewSSH(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	client, err := Connect(context.Background(), "ec2-user", &Host{
+		Address:      server.Addr,
+		Key:          key,
+		Fingerprints: []string{server.Fingerprint},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return server, client
+}
+
+func TestUploadDirectory(t *testing.T) {
+	server, client := connect(t)
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "roles", "common"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "site.yml"), []byte("- hosts: all\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "roles", "common", "main.yml"), []byte("tasks: []\n"), 0644)
+	if err := client.Upload(context.Background(), dir, "~/playbook"); err != nil {
+		t.Fatal(err)
+	}
+	files := server.Files()
+	if len(files) != 2 || string(files["/home/ec2-user/playbook/site.yml"]) != "- hosts: all\n" ||
+		string(files["/home/ec2-user/playbook/roles/common/main.yml"]) != "tasks: []\n" {
+		t.Errorf("unexpected files %q", files)
+	}
+}
+
+func TestUploadRetries(t *testing.T) {
+	defer func(wait time.Duration) { minBackoff = wait }(minBackoff)
+	minBackoff = time.Millisecond
+	server, client := connect(t)
+	server.FailUploads(2)
+	file := filepath.Join(t.TempDir(), "prov-client.rpm")
+	ioutil.WriteFile(file, []byte("rpm"), 0644)
+	if err := client.Upload(context.Background(), file, "/tmp/prov-client.rpm"); err != nil {
+		t.Fatal(err)
+	}
+	if data := server.Files()["/tmp/prov-client.rpm"]; string(data) != "rpm" {
+		t.Errorf("uploaded %q", data)
+	}
+
+	server.FailUploads(UploadAttempts)
+	err := client.Upload(context.Background(), file, "/tmp/prov-client.rpm")
+	if err == nil || !strings.Contains(err.Error(), "No space left on device") {
+		t.Errorf("expected the upload to fail, got %v", err)
+	}
+}